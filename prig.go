@@ -11,14 +11,20 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
+	"time"
 	"unicode/utf8"
 
 	importspkg "golang.org/x/tools/imports"
@@ -39,6 +45,27 @@ func main() {
 	var perRecord []string
 	fieldSep := " "
 	printSource := false
+	unbuffered := false
+	var flushInterval time.Duration
+	regexCacheSize := 100
+	timeZone := ""
+	printStats := false
+	strict := false
+	warn := false
+	joinFile := ""
+	joinCol := 1
+	joinKey := 1
+	joinMode := ""
+	joinHeader := false
+	parallel := 0
+	columnSpec := ""
+	fixedWidth := false
+	trimColumns := false
+	logfmt := false
+	format := ""
+	jsonArray := false
+	jsonPath := ""
+	promFile := ""
 	goExe := "go"
 
 	for i := 1; i < len(os.Args); {
@@ -64,6 +91,25 @@ func main() {
 			}
 			fieldSep = os.Args[i]
 			i++
+		case "-flush-interval":
+			if i >= len(os.Args) {
+				errorf("-flush-interval requires an argument")
+			}
+			d, err := time.ParseDuration(os.Args[i])
+			if err != nil || d <= 0 {
+				errorf("invalid flush interval %q", os.Args[i])
+			}
+			flushInterval = d
+			i++
+		case "-format":
+			if i >= len(os.Args) {
+				errorf("-format requires an argument")
+			}
+			format = os.Args[i]
+			if _, ok := logFormats[format]; !ok {
+				errorf("invalid format %q (must be combined, common, or syslog)", format)
+			}
+			i++
 		case "-g":
 			if i >= len(os.Args) {
 				errorf("-g requires an argument")
@@ -79,15 +125,114 @@ func main() {
 		case "-h", "--help":
 			fmt.Printf("%s\n", usage)
 			return
+		case "-json-array":
+			jsonArray = true
+		case "-jpath", "-json-path":
+			if i >= len(os.Args) {
+				errorf("%s requires an argument", arg)
+			}
+			jsonPath = os.Args[i]
+			i++
+		case "-jheader":
+			joinHeader = true
+		case "-jkey":
+			if i >= len(os.Args) {
+				errorf("-jkey requires an argument")
+			}
+			n, err := strconv.Atoi(os.Args[i])
+			if err != nil || n < 0 {
+				errorf("invalid join key field %q", os.Args[i])
+			}
+			joinKey = n
+			i++
+		case "-jmode":
+			if i >= len(os.Args) {
+				errorf("-jmode requires an argument")
+			}
+			joinMode = os.Args[i]
+			i++
+		case "-join":
+			if i >= len(os.Args) {
+				errorf("-join requires an argument")
+			}
+			joinFile = os.Args[i]
+			if colon := strings.LastIndex(joinFile, ":"); colon >= 0 {
+				n, err := strconv.Atoi(joinFile[colon+1:])
+				if err == nil {
+					if n < 1 {
+						errorf("invalid join key column %q", joinFile[colon+1:])
+					}
+					joinFile, joinCol = joinFile[:colon], n
+				}
+			}
+			i++
+		case "-logfmt":
+			logfmt = true
+		case "-P":
+			if i >= len(os.Args) {
+				errorf("-P requires an argument")
+			}
+			n, err := strconv.Atoi(os.Args[i])
+			if err != nil || n < 0 {
+				errorf("invalid number of commands %q", os.Args[i])
+			}
+			parallel = n
+			i++
+		case "-prom":
+			if i >= len(os.Args) {
+				errorf("-prom requires an argument")
+			}
+			promFile = os.Args[i]
+			i++
+		case "-recache":
+			if i >= len(os.Args) {
+				errorf("-recache requires an argument")
+			}
+			n, err := strconv.Atoi(os.Args[i])
+			if err != nil || n < 0 {
+				errorf("invalid regex cache size %q", os.Args[i])
+			}
+			regexCacheSize = n
+			i++
 		case "-s":
 			printSource = true
+		case "-stats":
+			printStats = true
+		case "-strict":
+			strict = true
+		case "-tz":
+			if i >= len(os.Args) {
+				errorf("-tz requires an argument")
+			}
+			_, err := time.LoadLocation(os.Args[i])
+			if err != nil {
+				errorf("invalid time zone: %v", err)
+			}
+			timeZone = os.Args[i]
+			i++
+		case "-u":
+			unbuffered = true
+		case "-trim":
+			trimColumns = true
 		case "-V", "--version":
 			fmt.Println(version)
 			return
+		case "-W":
+			if i >= len(os.Args) {
+				errorf("-W requires an argument")
+			}
+			columnSpec = os.Args[i]
+			fixedWidth = true
+			i++
+		case "-warn":
+			warn = true
 		default:
 			switch {
 			case strings.HasPrefix(arg, "-F"):
 				fieldSep = arg[2:]
+			case strings.HasPrefix(arg, "-W"):
+				columnSpec = arg[2:]
+				fixedWidth = true
 			default:
 				perRecord = append(perRecord, arg)
 			}
@@ -101,9 +246,43 @@ func main() {
 		}
 	}
 
-	// Use non-generic Sort/SortMap if importspkg.Process doesn't support
+	columns := "[]int(nil)"
+	if fixedWidth && columnSpec != "underline" {
+		offsets, err := parseColumns(columnSpec)
+		if err != nil {
+			errorf("invalid -W column spec %q: %v", columnSpec, err)
+		}
+		columns = fmt.Sprintf("%#v", offsets)
+	}
+	if trimColumns && !fixedWidth {
+		errorf("-trim requires -W")
+	}
+	if logfmt && (fieldSep != " " || fixedWidth) {
+		errorf("-logfmt can't be used with -F or -W")
+	}
+	if format != "" && (fieldSep != " " || fixedWidth || logfmt) {
+		errorf("-format can't be used with -F, -W, or -logfmt")
+	}
+	if jsonArray && (fieldSep != " " || fixedWidth || logfmt || format != "") {
+		errorf("-json-array can't be used with -F, -W, -logfmt, or -format")
+	}
+	if jsonPath != "" && !jsonArray {
+		errorf("-jpath requires -json-array")
+	}
+
+	switch {
+	case joinFile == "" && (joinMode != "" || joinKey != 1 || joinHeader):
+		errorf("-jkey, -jmode, and -jheader require -join")
+	case joinMode == "":
+		joinMode = "inner"
+	case joinMode != "inner" && joinMode != "left" && joinMode != "anti":
+		errorf("invalid join mode %q (must be inner, left, or anti)", joinMode)
+	}
+
+	// Use non-generic Sort/SortMap/etc if importspkg.Process doesn't support
 	// generics, or we're using a Go that doesn't support generics (<=1.17).
-	sortFuncs := sortGeneric
+	genericFuncs := sortGeneric + statsGeneric + counterGeneric + chartGeneric
+	nonGenericFuncs := sortNonGeneric + statsNonGeneric + counterNonGeneric + chartNonGeneric
 	cmd := exec.Command(goExe, "version")
 	output, err := cmd.CombinedOutput()
 	if err == nil {
@@ -111,24 +290,47 @@ func main() {
 		if matches != nil {
 			goMinor, _ := strconv.Atoi(string(matches[1]))
 			if goMinor <= 17 {
-				sortFuncs = sortNonGeneric
+				genericFuncs = nonGenericFuncs
 			}
 		}
 	}
 	_, err = importspkg.Process("", []byte("package x\nfunc f[T any]() {}"), nil)
 	if err != nil {
-		sortFuncs = sortNonGeneric
+		genericFuncs = nonGenericFuncs
 	}
 
 	// Write source code to buffer
 	var buffer bytes.Buffer
 	params := &templateParams{
-		FieldSep:  fieldSep,
-		Imports:   imports,
-		Begin:     begin,
-		PerRecord: perRecord,
-		End:       end,
-		SortFuncs: sortFuncs,
+		FieldSep:      fieldSep,
+		Unbuffered:    unbuffered,
+		FlushInterval: flushInterval,
+		RegexCache:    regexCacheSize,
+		Stats:         printStats,
+		TimeZone:      timeZone,
+		Strict:        strict,
+		Warn:          warn,
+		JoinFile:      joinFile,
+		JoinCol:       joinCol,
+		JoinKey:       joinKey,
+		JoinMode:      joinMode,
+		JoinHeader:    joinHeader,
+		Parallel:      parallel,
+		FixedWidth:    fixedWidth,
+		Columns:       columns,
+		Underline:     columnSpec == "underline",
+		TrimColumns:   trimColumns,
+		Logfmt:        logfmt,
+		Format:        format,
+		FormatRegex:   logFormats[format],
+		JSONArray:     jsonArray,
+		JSONPath:      jsonPath,
+		PromFile:      promFile,
+		Imports:       imports,
+		Begin:         begin,
+		PerRecord:     perRecord,
+		End:           end,
+		GenericFuncs:  genericFuncs,
 	}
 	err = sourceTemplate.Execute(&buffer, params)
 	if err != nil {
@@ -137,12 +339,19 @@ func main() {
 	bufferBytes := buffer.Bytes()
 
 	// Add imports (also pretty-prints for printSource mode).
-	sourceBytes, err := importspkg.Process("", bufferBytes, nil)
+	formattedBytes, err := importspkg.Process("", bufferBytes, nil)
 	if err != nil {
-		parsed := parseErrors(err.Error(), string(bufferBytes), params)
+		parsed := parseErrors(err.Error(), string(bufferBytes), nil, params)
 		fmt.Fprint(os.Stderr, parsed)
 		os.Exit(1)
 	}
+
+	// Check string literal regexes now, and compile them only once.
+	sourceBytes, regexEdits, err := precompileRegexes(formattedBytes)
+	if err != nil {
+		fmt.Fprint(os.Stderr, err)
+		os.Exit(1)
+	}
 	if printSource {
 		fmt.Print(string(sourceBytes))
 		return
@@ -176,19 +385,31 @@ func main() {
 	switch err.(type) {
 	case nil:
 	case *exec.ExitError:
-		parsed := parseErrors(string(output), string(sourceBytes), params)
+		parsed := parseErrors(string(output), string(formattedBytes), regexEdits, params)
 		fmt.Fprint(os.Stderr, parsed)
 		os.Exit(1)
 	default:
 		errorf("error building program: %v", err)
 	}
 
-	// Then run the executable we just built
+	// Then run the executable we just built, forwarding signals to it so
+	// that it can stop reading input and run the end code.
 	cmd = exec.Command(exeFilename)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	err = cmd.Start()
+	if err != nil {
+		errorf("error running program: %v", err)
+	}
+	go func() {
+		for sig := range signals {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+	err = cmd.Wait()
 	if err != nil {
 		exitCode := cmd.ProcessState.ExitCode()
 		if exitCode == -1 {
@@ -200,7 +421,11 @@ func main() {
 
 var compileErrorRe = regexp.MustCompile(`^(.*:)?(\d+):(\d+): (.*)`)
 
-func parseErrors(buildOutput string, source string, params *templateParams) string {
+// parseErrors formats the errors in buildOutput with the source line and a
+// caret. Positions are in source after edits are applied, and are mapped
+// back to source itself.
+func parseErrors(buildOutput string, source string, edits []sourceEdit, params *templateParams) string {
+	rewritten := string(applyEdits([]byte(source), edits))
 	var builder strings.Builder
 	lines := strings.Split(buildOutput, "\n")
 	for _, line := range lines {
@@ -215,12 +440,72 @@ func parseErrors(buildOutput string, source string, params *templateParams) stri
 		lineNum, _ := strconv.Atoi(matches[2])
 		colNum, _ := strconv.Atoi(matches[3])
 		message := matches[4]
+		if len(edits) > 0 {
+			lineNum, colNum = originalPosition(rewritten, source, lineNum, colNum, edits)
+			for name, reName := range regexFuncs {
+				message = strings.Replace(message, reName, name, -1)
+			}
+		}
 		sourceLine, caretLine := getSourceCaretLine(source, lineNum, colNum)
 		fmt.Fprintf(&builder, "main.go:%d:%d: %s\n%s\n%s\n", lineNum, colNum, message, sourceLine, caretLine)
 	}
 	return builder.String()
 }
 
+// sourceEdit replaces source[start:end] with text.
+type sourceEdit struct {
+	start, end int
+	text       string
+}
+
+// applyEdits returns source with edits applied. The edits must be in source
+// order and must not overlap.
+func applyEdits(source []byte, edits []sourceEdit) []byte {
+	if len(edits) == 0 {
+		return source
+	}
+	var result []byte
+	prev := 0
+	for _, e := range edits {
+		result = append(result, source[prev:e.start]...)
+		result = append(result, e.text...)
+		prev = e.end
+	}
+	return append(result, source[prev:]...)
+}
+
+// originalPosition maps a line and column in rewritten, which is original
+// with edits applied, back to a line and column in original. A position
+// inside an edit's text maps to the start of the text it replaced.
+func originalPosition(rewritten, original string, line, col int, edits []sourceEdit) (int, int) {
+	lines := strings.SplitAfter(rewritten, "\n")
+	if line < 1 || line > len(lines) {
+		return line, col
+	}
+	offset := col - 1
+	for _, l := range lines[:line-1] {
+		offset += len(l)
+	}
+	delta := 0 // length of rewritten minus length of original so far
+	for _, e := range edits {
+		start := e.start + delta
+		if offset < start {
+			break
+		}
+		if offset < start+len(e.text) {
+			delta = offset - e.start
+			break
+		}
+		delta += len(e.text) - (e.end - e.start)
+	}
+	offset -= delta
+	if offset < 0 || offset > len(original) {
+		return line, col
+	}
+	lineStart := strings.LastIndex(original[:offset], "\n") + 1
+	return strings.Count(original[:offset], "\n") + 1, offset - lineStart + 1
+}
+
 func getSourceCaretLine(source string, line, col int) (sourceLine, caretLine string) {
 	lines := strings.Split(source, "\n")
 	if line < 1 || line > len(lines) {
@@ -234,6 +519,199 @@ func getSourceCaretLine(source string, line, col int) (sourceLine, caretLine str
 	return sourceLine, caretLine
 }
 
+// regexFuncs maps the builtins that take a regex as their first argument
+// to the versions that take a compiled *regexp.Regexp instead.
+var regexFuncs = map[string]string{
+	"Match":        "_matchRe",
+	"Replace":      "_replaceRe",
+	"Submatches":   "_submatchesRe",
+	"NamedMatches": "_namedMatchesRe",
+	"AllMatches":   "_allMatchesRe",
+	"ReplaceFunc":  "_replaceFuncRe",
+	"Split":        "_splitRe",
+}
+
+// precompileRegexes rewrites calls to regex builtins whose regex is a string
+// literal to use a regex variable compiled once at startup, avoiding the
+// cache lookup on every call. It returns the rewritten source and the edits
+// made, or an error (formatted like a compile error) if one of those regexes
+// is invalid.
+func precompileRegexes(source []byte) ([]byte, []sourceEdit, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "main.go", source, parser.SkipObjectResolution)
+	if err != nil {
+		// Let "go build" report syntax errors.
+		return source, nil, nil
+	}
+
+	shadowed := localNames(file)
+	var edits []sourceEdit
+	var decls []string
+	varNames := make(map[string]string) // regex literal to variable name
+	var regexErr error
+	ast.Inspect(file, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 || regexErr != nil {
+			return true
+		}
+		ident, ok := call.Fun.(*ast.Ident)
+		if !ok || regexFuncs[ident.Name] == "" || shadowed[ident.Name] {
+			return true // not a regex builtin (or shadowed by a local)
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		re, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			return true
+		}
+		_, err = regexp.Compile(re)
+		if err != nil {
+			pos := fset.Position(lit.Pos())
+			sourceLine, caretLine := getSourceCaretLine(string(source), pos.Line, pos.Column)
+			regexErr = fmt.Errorf("main.go:%d:%d: invalid regex %q: %v\n%s\n%s\n",
+				pos.Line, pos.Column, re, err, sourceLine, caretLine)
+			return false
+		}
+		varName, ok := varNames[lit.Value]
+		if !ok {
+			varName = fmt.Sprintf("_re%d", len(varNames))
+			varNames[lit.Value] = varName
+			decls = append(decls, fmt.Sprintf("var %s = regexp.MustCompile(%s)\n", varName, lit.Value))
+		}
+		edits = append(edits,
+			sourceEdit{fset.Position(ident.Pos()).Offset, fset.Position(ident.End()).Offset, regexFuncs[ident.Name]},
+			sourceEdit{fset.Position(lit.Pos()).Offset, fset.Position(lit.End()).Offset, varName})
+		return true
+	})
+	if regexErr != nil {
+		return nil, nil, regexErr
+	}
+	if len(edits) == 0 {
+		return source, nil, nil
+	}
+
+	result := applyEdits(source, edits)
+	result = append(result, '\n')
+	for _, decl := range decls {
+		result = append(result, decl...)
+	}
+	return result, edits, nil
+}
+
+// localNames returns the names declared inside the main function (where
+// the user's code goes), which may shadow builtins of the same name.
+func localNames(file *ast.File) map[string]bool {
+	names := make(map[string]bool)
+	addIdents := func(exprs ...ast.Expr) {
+		for _, expr := range exprs {
+			if ident, ok := expr.(*ast.Ident); ok {
+				names[ident.Name] = true
+			}
+		}
+	}
+	addFields := func(fields *ast.FieldList) {
+		if fields == nil {
+			return
+		}
+		for _, field := range fields.List {
+			for _, name := range field.Names {
+				names[name.Name] = true
+			}
+		}
+	}
+	for _, decl := range file.Decls {
+		funcDecl, ok := decl.(*ast.FuncDecl)
+		if !ok || funcDecl.Name.Name != "main" || funcDecl.Recv != nil || funcDecl.Body == nil {
+			continue
+		}
+		ast.Inspect(funcDecl.Body, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.AssignStmt:
+				if node.Tok == token.DEFINE {
+					addIdents(node.Lhs...)
+				}
+			case *ast.RangeStmt:
+				if node.Tok == token.DEFINE {
+					addIdents(node.Key, node.Value)
+				}
+			case *ast.ValueSpec:
+				for _, name := range node.Names {
+					names[name.Name] = true
+				}
+			case *ast.TypeSpec:
+				names[node.Name.Name] = true
+			case *ast.FuncType:
+				addFields(node.Params)
+				addFields(node.Results)
+			}
+			return true
+		})
+	}
+	return names
+}
+
+// logFormats are the -format presets: regexes whose named groups are the
+// fields of each record.
+var logFormats = map[string]string{
+	"common":   commonLogRegex + `$`,
+	"combined": commonLogRegex + ` "(?P<referer>[^"]*)" "(?P<ua>[^"]*)"`,
+	"syslog": `^(?P<time>[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d) (?P<host>\S+) ` +
+		`(?P<program>[^:\[\s]+)(?:\[(?P<pid>\d+)\])?: (?P<message>.*)$`,
+}
+
+const commonLogRegex = `^(?P<ip>\S+) (?P<ident>\S+) (?P<user>\S+) \[(?P<time>[^\]]+)\] ` +
+	`"(?:(?P<method>[A-Z]+) (?P<path>\S+)(?: (?P<proto>[^"]*))?|[^"]*)" ` +
+	`(?P<status>\d{3}) (?P<bytes>\S+)`
+
+// parseColumns parses a -W column spec, either 1-based column ranges like
+// "1-8,9-20,21-" or widths like "8,12,*", and returns pairs of start and end
+// byte offsets (end is -1 for the rest of the line).
+func parseColumns(spec string) ([]int, error) {
+	if spec == "" {
+		return nil, fmt.Errorf("no columns given")
+	}
+	var offsets []int
+	isRanges := strings.Contains(spec, "-")
+	items := strings.Split(spec, ",")
+	pos := 0
+	for i, item := range items {
+		switch {
+		case isRanges:
+			parts := strings.SplitN(item, "-", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("%q is not a range", item)
+			}
+			start, err := strconv.Atoi(parts[0])
+			if err != nil || start < 1 {
+				return nil, fmt.Errorf("invalid start column %q", parts[0])
+			}
+			end := -1
+			if parts[1] != "" {
+				end, err = strconv.Atoi(parts[1])
+				if err != nil || end < start {
+					return nil, fmt.Errorf("invalid end column %q", parts[1])
+				}
+			}
+			offsets = append(offsets, start-1, end)
+		case item == "*":
+			if i != len(items)-1 {
+				return nil, fmt.Errorf("* must be the last width")
+			}
+			offsets = append(offsets, pos, -1)
+		default:
+			width, err := strconv.Atoi(item)
+			if err != nil || width < 1 {
+				return nil, fmt.Errorf("invalid width %q", item)
+			}
+			offsets = append(offsets, pos, pos+width)
+			pos += width
+		}
+	}
+	return offsets, nil
+}
+
 func errorf(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
 	os.Exit(1)
@@ -248,36 +726,244 @@ typing!). It runs 'begin code' first, then runs 'per-record code' for every
 record (line) in the input, then runs 'end code'. Prig uses "go build", so it
 requires the Go compiler: https://go.dev/doc/install
 
+If interrupted (SIGINT or SIGTERM) while reading input, Prig stops reading,
+runs 'end code', and exits with status 128+signal. A signal during 'begin
+code' or 'end code', or a second signal a while later, exits at once.
+
 Options:
   -F char | re     field separator (single character or multi-char regex)
+  -flush-interval duration
+                   also flush output periodically (eg: "1s")
+  -format name     parse records using log format preset, so fields are named
+                   (use KVS etc) as well as numbered; records that don't
+                   match are skipped, and the number skipped is printed to
+                   stderr at exit; formats and their fields are:
+                   common: ip ident user time method path proto status bytes
+                   combined: common fields plus referer ua
+                   syslog: time host program pid message
   -g executable    Go compiler to use (eg: "go1.18rc1", default "go")
   -h, --help       print help message and exit
   -i import        import Go package (normally automatic)
+  -join file[:col] join records with rows in file (CSV if file ends with .csv,
+                   TSV if .tsv, otherwise split like -F) whose field col
+                   (default 1) equals the record's key field; the number of
+                   unmatched records is printed to stderr at exit
+  -json-array      read input as a JSON array, with each element a record (S(0)
+                   is its JSON); use Path, PathS, etc to get its values
+  -jheader         first row of join file is a header (see JoinS)
+  -jkey i          key field of each record for -join (default 1)
+  -jmode mode      join mode: "inner" (default) processes matched records,
+                   "left" processes all records, "anti" unmatched records
+  -jpath path      with -json-array, read records from the array at path in
+                   the input (eg: "data.items"; indexes can't be negative);
+                   -json-path is an alias
+  -logfmt          parse records as logfmt key=value pairs, so fields are
+                   the values (also see KVS, which works in any mode)
+  -P n             run up to n commands started by Start at once (default
+                   number of CPUs)
+  -prom file       after 'end code', write Prometheus metrics (see PromCounter)
+                   to file (atomically, using a temp file), or stdout if "-"
+  -recache n       cache up to n compiled non-literal regexes (default 100)
   -s               print formatted Go source instead of running
+  -stats           print regex cache hits and misses to stderr at exit
+  -strict          exit with an error if I, F, Bytes, Dur, Int, T, or
+                   ParseTime can't parse a value (instead of returning 0)
+  -tz name         time zone for times without one (eg: "UTC", default local)
+  -trim            trim spaces from each -W field
+  -u               flush output after every Print call (the default if
+                   stdout is a terminal)
   -V, --version    print version number and exit
+  -W cols          split fixed-width columns instead of using -F: byte
+                   ranges (eg: "1-8,9-20,21-") or widths (eg: "8,12,*"), or
+                   "underline" to use the header's underline row ("--- ---");
+                   a multi-byte character split by a column boundary goes
+                   in the later column
+  -warn            count values I, F, etc can't parse, and print a summary
+                   to stderr after 'end code'
 
 Built-in functions:
   F(i int) float64 // return field i as float64, int, or string
   I(i int) int     // (i==0 is entire record, i==1 is first field)
   S(i int) string
 
+  MustI(i int) int     // like I and F, but exit with an error showing NR
+  MustF(i int) float64 // and field number if field i isn't a number
+
+  Bytes(i int) int           // return field i as size in bytes: K, M, G, T, P,
+                             // E, and KiB etc are powers of 1024; KB etc 1000
+  Dur(i int) time.Duration   // return field i as duration (eg: "1h2m", "250ms";
+                             // plain numbers are seconds)
+  Int(s string, base int) int
+    // parse s as integer in base (0 means from prefix: 0x, 0o, 0b, or 0 for
+    // octal), ignoring "," and "_" digit separators
+  HumanBytes(n int) string       // format size like "ls -h" (eg: "1.5K")
+  HumanDur(d time.Duration) string // format duration briefly (eg: "1h2m")
+  Commas(n int) string           // format with thousands separators
+  Bytes, Dur, and Int return 0 if they can't parse the value (see -strict)
+
   NF() int // return number of fields in current record
   NR() int // return number of current record
 
+  KVS(key string) string   // return value of key in record's logfmt
+  KVI(key string) int      // key=value pairs (quoted values can contain
+  KVF(key string) float64  // spaces), or "" or 0 if key isn't present
+  KVT(key string) time.Time // (or named -format field)
+  Keys() []string          // return keys in record's key=value pairs
+  Logfmt(kvs ...interface{}) string
+    // format alternating keys and values as logfmt, quoting if needed
+  PrintLogfmt(kvs ...interface{}) // print Logfmt(kvs...) and a newline
+
+  Path(path string) interface{} // return value at path in record's JSON,
+  PathS(path string) string     // for example "user.name" or "items.0.id"
+  PathI(path string) int        // ("" is the whole value); PathS returns
+  PathF(path string) float64    // objects and arrays as JSON
+
+  JS(i int) string        // return field i of join row matching record
+  JoinS(name string) string // return named field of join row (-jheader)
+  JS and JoinS return "" if no row matches (-jmode left)
+
+  T(i int) time.Time // return field i as time, auto-detecting its layout
+  ParseTime(s, layout string) time.Time
+    // parse s using layout, or auto-detect layout if it's ""
+    // auto-detects RFC3339, "2006-01-02 15:04:05", "20060102", Apache,
+    // syslog, RFC1123, and Unix epoch seconds, milliseconds, microseconds or
+    // nanoseconds (at least 9 digits, so "2022" isn't taken as epoch time)
+  Epoch(t time.Time) int                 // return Unix time in seconds
+  Bucket(t time.Time, d time.Duration) time.Time
+    // round t down to multiple of d (aligned to local time zone)
+  T and ParseTime return the zero time.Time if s can't be parsed, and use the
+  current (or previous) year for layouts without one, such as syslog's
+
   Print(args ...interface{})                 // fmt.Print, but buffered
   Printf(format string, args ...interface{}) // fmt.Printf, but buffered
   Println(args ...interface{})               // fmt.Println, but buffered
+  Flush()                                    // flush buffered output
+
+  PrintTo(name string, args ...interface{})   // like Print, Printf, and
+  PrintfTo(name, format string, args ...interface{}) // Println, but write
+  PrintlnTo(name string, args ...interface{}) // to file (created on first
+                                              // write; "/dev/stderr" is OK,
+                                              // and "/dev/stdout" or "-"
+                                              // write to buffered output)
+  PipeTo(command string, args ...interface{})
+    // like Println, but write to stdin of shell command (started on first
+    // write, using "sh -c")
+  Close(name string) // close file or pipe (waits for command to finish),
+                     // or file being read by Getline
+  Files and pipes are closed at exit, and least recently used files are
+  closed (and reopened for appending) if more than 100 files and pipes are
+  open
+
+  Lines(path string) []string            // return lines in file
+  ReadFields(path, sep string) [][]string
+    // return lines in file split into fields (sep works like -F; "" means
+    // use -F field separator)
+  Getline(path string) (string, bool)    // return next line in file, or
+                                         // false at end of file
+  Command(command string) []string
+    // run shell command using "sh -c" and return its output lines
+
+  System(command string) int
+    // run shell command using "sh -c" and return its exit status
+  Exec(name string, args ...string) (string, int)
+    // run program (without a shell) and return its output and exit status
+  Start(name string, args ...string)
+    // start program (without a shell) in the background, at most -P at once;
+    // its output is printed when it finishes
+  Wait() int // wait for started programs; return number that failed
+  These flush output first; the program's stdin is /dev/null
 
   Match(re, s string) bool            // report whether s contains match of re
   Replace(re, s, repl string) string  // replace all re matches in s with repl
   Submatches(re, s string) []string   // return slice of submatches of re in s
+  NamedMatches(re, s string) map[string]string
+    // return map of named (?P<name>re) submatches of re in s
+  AllMatches(re, s string) [][]string
+    // return all matches of re in s: each is the match and its submatches
+  ReplaceFunc(re, s string, repl func(string) string) string
+    // replace all re matches in s with repl(match)
+  Split(re, s string) []string        // split s into substrings separated by re
   Substr(s string, n[, m] int) string // s[n:m] but safe and allow negative n/m
 
+  RSubstr(s string, n[, m] int) string // like Substr, but n/m index runes
+  RuneLen(s string) int                // return number of runes in s
+  Width(s string) int                  // return display width of s (East
+                                       // Asian wide characters count 2)
+  Pad(s string, width int) string      // pad s with spaces to display width
+                                       // (align right if width is negative)
+  Truncate(s string, width int, ellipsis string) string
+    // truncate s to display width, ending with ellipsis if truncated
+
   Sort[T int|float64|string](s []T) []T
     // return new sorted slice; also Sort(s, Reverse) to sort descending
   SortMap[T int|float64|string](m map[string]T) []KV[T]
-    // return sorted slice of key-value pairs
+    // return sorted slice of key-value pairs (fields K and V)
     // also SortMap(s[, Reverse][, ByValue]) to sort descending or by value
+  SortPairs[K ordered, V int|float64|string](m map[K]V) []Pair[K, V]
+    // like SortMap, but for any ordered key type, eg: map[int]string
+  SortBy[T any, K int|float64|string](s []T, key func(T) K) []T
+    // return new slice sorted by key(elem); also SortBy(s, key, Reverse)
+  SortFunc[T any](s []T, less func(a, b T) bool) []T
+    // return new slice sorted using less; also SortFunc(s, less, Reverse)
+  SortKeys[T any](s []T, keys ...SortKey[T]) []T
+    // return new slice sorted by several keys, using Asc(key) or Desc(key)
+    // eg: SortKeys(s, Asc(func(x T) string {...}), Desc(func(x T) int {...}))
+    // (sorts are stable: equal elements keep their original order)
+  Sort, SortMap, SortPairs, and SortBy also accept a Natural option to sort strings
+  containing numbers naturally ("file2" before "file10"), or Numeric to sort
+  strings by numeric value (non-numbers last)
+
+  Sum, Min, Max[T int|float64](s []T) T
+    // return sum, minimum, or maximum of s (0 if s is empty)
+  Mean, Median, StdDev[T int|float64](s []T) float64
+  Percentile[T int|float64](s []T, p float64) float64
+    // return statistics of s (NaN if s is empty); StdDev is the population
+    // standard deviation; Percentile interpolates, with p from 0 to 100
+
+  Histogram[T int|float64](values []T, n int)
+    // print bar chart of counts of values in n equal-width buckets (from
+    // the minimum to the maximum finite value)
+  HistogramEdges[T int|float64](values []T, edges []float64)
+    // print bar chart of counts of values in buckets with given edges
+    // (values outside the edges, and NaNs, are counted in extra rows)
+  BarChart(kvs []KV[T] or []Pair[K, V])
+    // print bar chart of key-value pairs, eg: BarChart(SortMap(m, ByValue))
+  Sparkline(values []float64) string // return values as "▁▃▅█" etc
+  Charts are scaled to the width in $COLUMNS (default 80); Histogram,
+  HistogramEdges, and BarChart also accept a LogScale option for log-scaled
+  bar lengths
+
+  NewTDigest() *TDigest
+    // streaming quantile estimates: d.Add(x float64), d.Quantile(q float64)
+    // with q from 0 to 1, d.Count() int, d.Merge(other *TDigest)
+  NewDistinctCounter() *DistinctCounter
+    // estimate number of distinct strings (HyperLogLog, about 1% error):
+    // c.Add(s string), c.Estimate() int, c.Merge(other *DistinctCounter)
+  Quantiles(m map[string]*TDigest, q float64) map[string]float64
+  Estimates(m map[string]*DistinctCounter) map[string]int
+    // return map of each q quantile or estimate, for use with SortMap
+
+  Counter[K int|float64|string]
+    // count keys (zero value is ready to use): c.Inc(key K), c.Add(key K,
+    // n int), c.Get(key K) int, c.Len() int, c.Total() int; c.Top(k int)
+    // and c.Bottom(k int) return the k most or least frequent keys as a
+    // []Count[K] (fields K and N), found using a heap
+
+  NewGroup(names ...string) *Group
+    // aggregate records by key: g.Key(keys ...interface{}) returns the row
+    // for those keys and increments its Count; row.Add(metric string,
+    // x float64) updates the metric's count, sum, min, max, and mean
+    // g.Report([Reverse][, ByValue]) prints a table sorted by key or count
+    // g.Rows(...) returns the sorted rows; row.Stat(metric) returns a *Stat
+
+  PromCounter(name, help string, labels ...string) *Metric
+  PromGauge(name, help string, labels ...string) *Metric
+  PromHistogram(name, help string, buckets []float64, labels ...string) *Metric
+    // return Prometheus metric with given label name-value pairs, creating
+    // it the first time; m.Inc() and m.Add(x) update counters and gauges,
+    // m.Set(x) sets gauges, and m.Observe(x) adds x to a histogram (nil
+    // buckets means the Prometheus defaults, and later calls must give the
+    // same buckets); see -prom
 
 Examples:
   # Run an arbitrary Go snippet; don't process input
@@ -304,22 +990,66 @@ const (
 )
 
 var imports = map[string]struct{}{
-	"bufio":   {},
-	"fmt":     {},
-	"os":      {},
-	"regexp":  {},
-	"sort":    {},
-	"strconv": {},
-	"strings": {},
+	"bufio":          {},
+	"bytes":          {},
+	"container/heap": {},
+	"container/list": {},
+	"encoding/csv":   {},
+	"encoding/json":  {},
+	"errors":         {},
+	"fmt":            {},
+	"io":             {},
+	"math":           {},
+	"math/bits":      {},
+	"os":             {},
+	"os/exec":        {},
+	"os/signal":      {},
+	"path/filepath":  {},
+	"reflect":        {},
+	"runtime":        {},
+	"regexp":         {},
+	"sort":           {},
+	"strconv":        {},
+	"strings":        {},
+	"sync":           {},
+	"sync/atomic":    {},
+	"syscall":        {},
+	"text/tabwriter": {},
+	"time":           {},
+	"unicode":        {},
+	"unicode/utf8":   {},
 }
 
 type templateParams struct {
-	FieldSep  string
-	Imports   map[string]struct{}
-	Begin     []string
-	PerRecord []string
-	End       []string
-	SortFuncs string
+	FieldSep      string
+	Unbuffered    bool
+	FlushInterval time.Duration
+	RegexCache    int
+	Stats         bool
+	TimeZone      string
+	Strict        bool
+	Warn          bool
+	JoinFile      string
+	JoinCol       int
+	JoinKey       int
+	JoinMode      string
+	JoinHeader    bool
+	Parallel      int
+	FixedWidth    bool
+	Columns       string // Go expression for _columns
+	Underline     bool
+	TrimColumns   bool
+	Logfmt        bool
+	Format        string
+	FormatRegex   string
+	JSONArray     bool
+	JSONPath      string
+	PromFile      string
+	Imports       map[string]struct{}
+	Begin         []string
+	PerRecord     []string
+	End           []string
+	GenericFuncs  string
 }
 
 var sourceTemplate = template.Must(template.New("source").Parse(`// Code generated by Prig (https://github.com/benhoyt/prig). DO NOT EDIT.
@@ -333,34 +1063,65 @@ import (
 )
 
 var (
-	_output *bufio.Writer
-	_record string
-	_nr     int
-    _fields []string
+	_output       *bufio.Writer
+	_outputMu     sync.Mutex
+	_lineBuffered bool
+	_record       string
+	_nr           int
+    _fields       []string
+	_signal       int32 // signal that stopped input (accessed atomically)
+	_reading      int32 // 1 while reading input (accessed atomically)
+	_stdinWriter  *io.PipeWriter
+	_location     = time.Local
 )
 
 func main() {
 	_output = bufio.NewWriter(os.Stdout)
-	defer _output.Flush()
+	_lineBuffered = {{.Unbuffered}} || _isTerminal(os.Stdout)
+	defer _finish()
+	_handleSignals()
+{{if .JoinFile}}
+	_loadJoin({{printf "%q" .JoinFile}}, {{.JoinCol}}, {{.JoinHeader}})
+{{end}}
+{{if .TimeZone}}
+	_setLocation({{printf "%q" .TimeZone}})
+{{end}}
+{{if .FlushInterval}}
+	go func() {
+		for range time.Tick({{printf "%d" .FlushInterval}}) {
+			Flush()
+		}
+	}()
+{{end}}
 
 {{range .Begin}}
 {{. -}}
 {{end}}
 
 {{if or .PerRecord .End}}
-	_scanner := bufio.NewScanner(os.Stdin)
-	for _scanner.Scan() {
-		_record = _scanner.Text()
+{{if .JSONArray}}
+	_nextRecord := _jsonRecords(_readStdin(), {{printf "%q" .JSONPath}})
+{{else}}
+	_nextRecord := _lineRecords(_readStdin())
+{{end}}
+	for atomic.LoadInt32(&_signal) == 0 && _nextRecord() {
         _nr++
-        _fields = nil
+{{if .Format}}
+		if !_parseFormat() {
+			continue
+		}
+{{end}}
+{{if .JoinFile}}
+		if !_joinRecord() {
+			continue
+		}
+{{end}}
 
 {{range .PerRecord}}
 {{. -}}
 {{end}}
 	}
-	if _scanner.Err() != nil {
-		_errorf("error reading stdin: %v", _scanner.Err())
-	}
+	atomic.StoreInt32(&_reading, 0)
 {{end}}
 
 {{range .End}}
@@ -369,196 +1130,3083 @@ func main() {
 }
 
 func Print(args ...interface{}) {
+	_outputMu.Lock()
+	defer _outputMu.Unlock()
 	_, err := fmt.Fprint(_output, args...)
-	if err != nil {
-		_errorf("error writing output: %v", err)
-	}
+	_afterWrite(err)
 }
 
 func Printf(format string, args ...interface{}) {
+	_outputMu.Lock()
+	defer _outputMu.Unlock()
 	_, err := fmt.Fprintf(_output, format, args...)
-	if err != nil {
-		_errorf("error writing output: %v", err)
-	}
+	_afterWrite(err)
 }
 
 func Println(args ...interface{}) {
+	_outputMu.Lock()
+	defer _outputMu.Unlock()
 	_, err := fmt.Fprintln(_output, args...)
-	if err != nil {
-		_errorf("error writing output: %v", err)
-	}
+	_afterWrite(err)
 }
 
-func NR() int {
-	return _nr
+func Flush() {
+	_outputMu.Lock()
+	defer _outputMu.Unlock()
+	_afterWrite(_output.Flush())
 }
 
-func S(i int) string {
-	if i == 0 {
-		return _record
+// _afterWrite reports a write error, or flushes if output is line
+// buffered. It must be called with _outputMu held.
+func _afterWrite(err error) {
+	if err == nil && _lineBuffered {
+		err = _output.Flush()
+	}
+	if errors.Is(err, syscall.EPIPE) {
+		// Reader has gone away, for example "prig ... | head"
+		os.Exit(128 + int(syscall.SIGPIPE))
 	}
-	_ensureFields()
-    if i < 1 || i > len(_fields) {
-        return ""
-    }
-    return _fields[i-1]
-}
-
-func I(i int) int {
-	s := S(i)
-	n, err := strconv.Atoi(s)
 	if err != nil {
-		f, _ := strconv.ParseFloat(s, 64)
-		return int(f)
+		_errorf("error writing output: %v", err)
 	}
-	return n
 }
 
-func F(i int) float64 {
-	s := S(i)
-	f, _ := strconv.ParseFloat(s, 64)
-	return f
+const _maxOpenFiles = 100
+
+// _outputStream is a file or pipe opened by PrintTo, PipeTo, and friends.
+type _outputStream struct {
+	writer *bufio.Writer
+	closer io.Closer     // nil for /dev/stderr
+	cmd    *exec.Cmd     // nil for files
+	elem   *list.Element // element in _fileOrder, nil for pipes
 }
 
-var _fieldSepRegex *regexp.Regexp
+var (
+	_outputStreams = make(map[string]*_outputStream)
+	_fileOrder     = list.New() // names of open files, most recently used first
+	_openPipes     int
+	_createdFiles  = make(map[string]bool)
+)
 
-func _ensureFields() {
-	if _fields != nil {
+func PrintTo(name string, args ...interface{}) {
+	if _isStdout(name) {
+		Print(args...)
 		return
 	}
-{{if eq .FieldSep " "}}
-	_fields = strings.Fields(_record)
-{{else}}
-	if _record == "" {
-		_fields = []string{}
+	stream := _openFile(name)
+	_, err := fmt.Fprint(stream.writer, args...)
+	_afterStreamWrite(name, stream, err)
+}
+
+func PrintfTo(name, format string, args ...interface{}) {
+	if _isStdout(name) {
+		Printf(format, args...)
 		return
 	}
-{{if le (len .FieldSep) 1}}
-		_fields = strings.Split(_record, {{printf "%q" .FieldSep}})
-{{else}}
-		if _fieldSepRegex == nil {
-			_fieldSepRegex = regexp.MustCompile({{printf "%q" .FieldSep}})
-		}
-		_fields = _fieldSepRegex.Split(_record, -1)
-{{end}}
-{{end}}
+	stream := _openFile(name)
+	_, err := fmt.Fprintf(stream.writer, format, args...)
+	_afterStreamWrite(name, stream, err)
 }
 
-func NF() int {
-	_ensureFields()
-	return len(_fields)
+func PrintlnTo(name string, args ...interface{}) {
+	if _isStdout(name) {
+		Println(args...)
+		return
+	}
+	stream := _openFile(name)
+	_, err := fmt.Fprintln(stream.writer, args...)
+	_afterStreamWrite(name, stream, err)
 }
 
-func Match(re, s string) bool {
-	regex := _reCompile(re)
-	return regex.MatchString(s)
+func PipeTo(command string, args ...interface{}) {
+	stream := _openPipe(command)
+	_, err := fmt.Fprintln(stream.writer, args...)
+	_afterStreamWrite(command, stream, err)
 }
 
-func Replace(re, s, repl string) string {
-	regex := _reCompile(re)
-	return regex.ReplaceAllString(s, repl)
+// _isStdout reports whether name refers to standard output, which is
+// written via the buffered output used by Print so that the order of
+// output is kept (and stdout isn't truncated if it's redirected to a file).
+func _isStdout(name string) bool {
+	return name == "/dev/stdout" || name == "-"
 }
 
-func Submatches(re, s string) []string {
-	regex := _reCompile(re)
-	matches := regex.FindStringSubmatch(s)
-	if matches == nil {
-		return nil
+// _openFile returns the stream for the named file, creating the file the
+// first time it's written to and reopening it for appending if it was
+// closed to stay under _maxOpenFiles.
+func _openFile(name string) *_outputStream {
+	if stream, ok := _outputStreams[name]; ok {
+		if stream.elem != nil {
+			_fileOrder.MoveToFront(stream.elem)
+		}
+		return stream
 	}
-	return matches[1:]
-}
-
-var _reCache = make(map[string]*regexp.Regexp)
-
-func _reCompile(re string) *regexp.Regexp {
-	if regex, ok := _reCache[re]; ok {
-		return regex
+	if name == "/dev/stderr" {
+		// Don't open (and truncate) stderr if it's redirected to a file.
+		stream := &_outputStream{writer: bufio.NewWriter(os.Stderr)}
+		_outputStreams[name] = stream
+		return stream
 	}
-	regex, err := regexp.Compile(re)
+	_makeRoom()
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if _createdFiles[name] {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(name, flags, 0666)
 	if err != nil {
-		_errorf("invalid regex %q: %v", re, err)
+		_errorf("error opening output file: %v", err)
 	}
-	// Dumb, non-LRU cache: just cache the first 100 regexes
-	if len(_reCache) < 100 {
-		_reCache[re] = regex
+	_createdFiles[name] = true
+	stream := &_outputStream{
+		writer: bufio.NewWriter(file),
+		closer: file,
+		elem:   _fileOrder.PushFront(name),
 	}
-	return regex
+	_outputStreams[name] = stream
+	return stream
 }
 
-func Substr(s string, n int, ms ...int) string {
-	var m int
-	switch len(ms) {
-	case 0:
-		m = len(s)
-	case 1:
-		m = ms[0]
-	default:
-		_errorf("Substr takes 2 or 3 arguments, not %d", len(ms)+2)
+func _openPipe(command string) *_outputStream {
+	if stream, ok := _outputStreams[command]; ok {
+		return stream
 	}
-
-	if n < 0 {
-		n = len(s) + n
-		if n < 0 {
-			n = 0
-		}
+	_makeRoom()
+	Flush() // so command's output appears after what we've printed
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		_errorf("error starting %q: %v", command, err)
 	}
-	if n > len(s) {
-		n = len(s)
+	stream := &_outputStream{
+		writer: bufio.NewWriter(stdin),
+		closer: stdin,
+		cmd:    cmd,
 	}
+	_outputStreams[command] = stream
+	_openPipes++
+	return stream
+}
 
-	if m < 0 {
-		m = len(s) + m
-		if m < 0 {
-			m = 0
+// _makeRoom closes least recently used files so that opening another file
+// or pipe stays under _maxOpenFiles. Pipes count toward the limit but aren't
+// closed, as that would end their commands early.
+func _makeRoom() {
+	for _fileOrder.Len()+_openPipes >= _maxOpenFiles {
+		if _fileOrder.Len() == 0 {
+			_errorf("too many open pipes (maximum %d)", _maxOpenFiles)
 		}
+		_closeOutput(_fileOrder.Back().Value.(string))
 	}
-	if m > len(s) {
-		m = len(s)
-	}
+}
 
-	if n > m {
-		return ""
+func _afterStreamWrite(name string, stream *_outputStream, err error) {
+	if err == nil && stream.closer == nil {
+		err = stream.writer.Flush() // stderr is unbuffered
+	}
+	if err != nil && !(stream.cmd != nil && errors.Is(err, syscall.EPIPE)) {
+		_errorf("error writing to %q: %v", name, err)
 	}
-
-	return s[n:m]
 }
 
-type _sortOption int
+// Close flushes and closes the named file or pipe, waiting for a pipe's
+// command to finish. A file written to after it's closed is truncated again.
+// It also closes a file being read by Getline, so it's read from the start
+// again by the next Getline. Closing "/dev/stdout" or "-" just flushes.
+func Close(name string) {
+	if _isStdout(name) {
+		Flush()
+		return
+	}
+	_closeOutput(name)
+	delete(_createdFiles, name)
+	if closer, ok := _getlineClosers[name]; ok {
+		closer.Close()
+		delete(_getlineClosers, name)
+		delete(_getlineFiles, name)
+	}
+}
+
+func _closeOutput(name string) {
+	stream, ok := _outputStreams[name]
+	if !ok {
+		return
+	}
+	delete(_outputStreams, name)
+	if stream.elem != nil {
+		_fileOrder.Remove(stream.elem)
+	}
+	if stream.cmd != nil {
+		_openPipes--
+		Flush() // so command's remaining output appears after what we've printed
+	}
+	err := stream.writer.Flush()
+	if stream.closer != nil {
+		closeErr := stream.closer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil && !(stream.cmd != nil && errors.Is(err, syscall.EPIPE)) {
+		_errorf("error writing to %q: %v", name, err)
+	}
+	if stream.cmd != nil {
+		// Like AWK, ignore the command's exit status.
+		_ = stream.cmd.Wait()
+	}
+}
+
+func _closeOutputs() {
+	for name := range _outputStreams {
+		_closeOutput(name)
+	}
+}
+
+// _handleSignals makes SIGINT and SIGTERM stop reading input (so the end
+// code still runs), and makes writes to a closed pipe return EPIPE rather
+// than killing the program. A signal that arrives when input isn't being
+// read exits right away.
+func _handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGPIPE)
+	go func() {
+		var first time.Time
+		for sig := range signals {
+			if sig == syscall.SIGPIPE {
+				continue
+			}
+			// Prig forwards signals that the terminal may also have sent us
+			// directly, so ignore a repeat that follows closely.
+			if !first.IsZero() && time.Since(first) < time.Second {
+				continue
+			}
+			signum := int(sig.(syscall.Signal))
+			if first.IsZero() && atomic.LoadInt32(&_reading) == 1 {
+				first = time.Now()
+				atomic.StoreInt32(&_signal, int32(signum))
+				if _stdinWriter != nil {
+					_stdinWriter.Close()
+				}
+				continue
+			}
+			os.Exit(128 + signum)
+		}
+	}()
+}
+
+// _readStdin returns a reader for stdin and marks input as being read. If
+// stdin isn't a regular file, reads may block indefinitely, so it copies
+// stdin to a pipe that _handleSignals can close.
+func _readStdin() io.Reader {
+	info, err := os.Stdin.Stat()
+	if err == nil && info.Mode().IsRegular() {
+		atomic.StoreInt32(&_reading, 1)
+		return os.Stdin
+	}
+	r, w := io.Pipe()
+	_stdinWriter = w
+	atomic.StoreInt32(&_reading, 1)
+	go func() {
+		_, err := io.Copy(w, os.Stdin)
+		w.CloseWithError(err)
+	}()
+	return r
+}
+
+// _setRecord makes s the current record.
+func _setRecord(s string) {
+	_record = s
+	_fields = nil
+	_kvParsed = false
+	_jsonParsed = false
+}
+
+// _lineRecords returns a function that reads the next line from r and makes
+// it the current record, returning false at the end of the input.
+func _lineRecords(r io.Reader) func() bool {
+	scanner := bufio.NewScanner(r)
+	return func() bool {
+		for scanner.Scan() {
+{{if .Underline}}
+			if _columns == nil {
+				// Skip header lines up to and including the underline row.
+				_columns = _underlineColumns(scanner.Text())
+				continue
+			}
+{{end}}
+			_setRecord(scanner.Text())
+			return true
+		}
+		if scanner.Err() != nil {
+			_errorf("error reading stdin: %v", scanner.Err())
+		}
+{{if .Underline}}
+		if _columns == nil && atomic.LoadInt32(&_signal) == 0 {
+			_errorf("no underline row found for -W underline")
+		}
+{{end}}
+		return false
+	}
+}
+
+// _finish flushes output and, if a signal stopped input, exits with the
+// conventional status for that signal.
+func _finish() {
+	Wait()
+{{if .PromFile}}
+	_writeMetrics({{printf "%q" .PromFile}})
+{{end}}
+	Flush()
+	_closeOutputs()
+	if _convErrors > 0 {
+		plural := "s"
+		if _convErrors == 1 {
+			plural = ""
+		}
+		fmt.Fprintf(os.Stderr, "warning: %d conversion error%s, first at %s\n", _convErrors, plural, _firstConvError)
+	}
+{{if .Format}}
+	if _formatSkipped > 0 {
+		fmt.Fprintf(os.Stderr, "format: skipped %d of %d records not in {{.Format}} format (first NR %d)\n",
+			_formatSkipped, _nr, _formatFirstNR)
+	}
+{{end}}
+	if {{printf "%q" .JoinMode}} != "anti" && _joinUnmatched > 0 {
+		fmt.Fprintf(os.Stderr, "join: %d of %d records unmatched\n", _joinUnmatched, _nr)
+	}
+	if {{.Stats}} {
+		fmt.Fprintf(os.Stderr, "regex cache: %d hits, %d misses\n", _reCache.hits, _reCache.misses)
+	}
+	if signum := atomic.LoadInt32(&_signal); signum != 0 {
+		os.Exit(128 + int(signum))
+	}
+}
+
+// _isTerminal reports whether f is a terminal. It actually checks for a
+// character device, but excludes the null device so that output to
+// /dev/null isn't line buffered (which would be much slower).
+func _isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+func NR() int {
+	return _nr
+}
+
+func S(i int) string {
+	if i == 0 {
+		return _record
+	}
+	_ensureFields()
+    if i < 1 || i > len(_fields) {
+        return ""
+    }
+    return _fields[i-1]
+}
+
+func I(i int) int {
+	s := S(i)
+	n, ok := _parseI(s)
+	if !ok {
+		_convError(_field(i), s, "integer")
+	}
+	return n
+}
+
+func F(i int) float64 {
+	s := S(i)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		_convError(_field(i), s, "number")
+	}
+	return f
+}
+
+func MustI(i int) int {
+	s := S(i)
+	n, ok := _parseI(s)
+	if !ok {
+		_errorf("%s", _convMessage(_field(i), s, "integer"))
+	}
+	return n
+}
+
+func MustF(i int) float64 {
+	s := S(i)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		_errorf("%s", _convMessage(_field(i), s, "number"))
+	}
+	return f
+}
+
+func _parseI(s string) (int, bool) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		f, err := strconv.ParseFloat(s, 64)
+		return int(f), err == nil
+	}
+	return n, true
+}
+
+const (
+	_strict = {{.Strict}}
+	_warn   = {{.Warn}}
+)
+
+var (
+	_convErrors     int
+	_firstConvError string
+)
+
+// _convError is called when a lenient conversion builtin can't parse s,
+// from where in the record (such as "field 2", or "" if s isn't from the
+// record). It exits with an error in -strict mode, and counts the error in
+// -warn mode.
+func _convError(where, s, kind string) {
+	if _strict {
+		_errorf("%s", _convMessage(where, s, kind))
+	}
+	if _warn {
+		if _convErrors == 0 {
+			_firstConvError = _convMessage(where, s, kind)
+		}
+		_convErrors++
+	}
+}
+
+func _convMessage(where, s, kind string) string {
+	if where == "" {
+		return fmt.Sprintf("NR %d: invalid %s %q", _nr, kind, s)
+	}
+	return fmt.Sprintf("NR %d, %s: invalid %s %q", _nr, where, kind, s)
+}
+
+func _field(i int) string {
+	return "field " + strconv.Itoa(i)
+}
+
+func Bytes(i int) int {
+	s := S(i)
+	n, err := _parseBytes(s)
+	if err != nil {
+		_convError(_field(i), s, "size")
+	}
+	return n
+}
+
+// _byteUnits are the size suffixes _parseBytes accepts (case insensitive).
+// Single letter suffixes are binary, like "ls -h" and "du -h" output.
+var _byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1e3,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1e6,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1e9,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1e12,
+	"tib": 1 << 40,
+	"p":   1 << 50,
+	"pb":  1e15,
+	"pib": 1 << 50,
+	"e":   1 << 60,
+	"eb":  1e18,
+	"eib": 1 << 60,
+}
+
+func _parseBytes(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r == '.' || r == ',' || r == '_' || r == '-' || r == '+')
+	})
+	if end < 0 {
+		end = len(s)
+	}
+	end += _exponentLen(s[end:])
+	number := strings.NewReplacer(",", "", "_", "").Replace(s[:end])
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, err
+	}
+	unit := strings.ToLower(strings.TrimSpace(s[end:]))
+	multiplier, ok := _byteUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit %q", s[end:])
+	}
+	return int(math.Round(f * multiplier)), nil
+}
+
+// _exponentLen returns the length of the float exponent (like "e3" or
+// "E-2") at the start of s, or 0 if there isn't one, so that an "e" or "eb"
+// unit isn't taken as an exponent.
+func _exponentLen(s string) int {
+	if len(s) < 2 || s[0] != 'e' && s[0] != 'E' {
+		return 0
+	}
+	i := 1
+	if s[i] == '+' || s[i] == '-' {
+		i++
+	}
+	start := i
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == start {
+		return 0
+	}
+	return i
+}
+
+func Dur(i int) time.Duration {
+	s := S(i)
+	d, err := _parseDur(s)
+	if err != nil {
+		_convError(_field(i), s, "duration")
+	}
+	return d
+}
+
+func _parseDur(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	f, err := strconv.ParseFloat(s, 64)
+	if err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+func Int(s string, base int) int {
+	n, err := _parseInt(s, base)
+	if err != nil {
+		_convError("", s, "integer")
+	}
+	return n
+}
+
+func _parseInt(s string, base int) (int, error) {
+	s = strings.NewReplacer(",", "", "_", "").Replace(strings.TrimSpace(s))
+	n, err := strconv.ParseInt(s, base, 64)
+	return int(n), err
+}
+
+// HumanBytes formats n bytes like "ls -h" does: values 10 and over are
+// rounded up to a whole number, smaller values to one decimal place.
+func HumanBytes(n int) string {
+	if n < 0 {
+		// Negate as uint64, as -n overflows if n is math.MinInt.
+		return "-" + _humanBytes(-uint64(n))
+	}
+	return _humanBytes(uint64(n))
+}
+
+func _humanBytes(n uint64) string {
+	if n < 1024 {
+		return strconv.FormatUint(n, 10)
+	}
+	const units = "KMGTPE"
+	value := float64(n)
+	for i := 0; ; i++ {
+		value /= 1024
+		if value < 10 {
+			value = math.Ceil(value*10) / 10
+			if value < 10 {
+				return strconv.FormatFloat(value, 'f', 1, 64) + units[i:i+1]
+			}
+		}
+		value = math.Ceil(value)
+		if value < 1024 || i == len(units)-1 {
+			return strconv.FormatFloat(value, 'f', 0, 64) + units[i:i+1]
+		}
+	}
+}
+
+// HumanDur formats d with about three significant digits, or with its two
+// largest units if it's a minute or more.
+func HumanDur(d time.Duration) string {
+	if d < 0 {
+		// Negate as uint64, as -d overflows if d is math.MinInt64.
+		return "-" + _humanDur(-uint64(d))
+	}
+	return _humanDur(uint64(d))
+}
+
+// _humanDur formats ns nanoseconds for HumanDur. It rounds before choosing
+// the unit, so that 59.999s is "1m0s" rather than "60s".
+func _humanDur(ns uint64) string {
+	if ns < uint64(time.Microsecond) {
+		return strconv.FormatUint(ns, 10) + "ns"
+	}
+	units := []struct {
+		name  string
+		size  time.Duration
+		limit float64 // size of the next unit, in this unit
+	}{
+		{"µs", time.Microsecond, 1000},
+		{"ms", time.Millisecond, 1000},
+		{"s", time.Second, 60},
+	}
+	for _, unit := range units {
+		s := _formatSignificant(float64(ns) / float64(unit.size))
+		if f, _ := strconv.ParseFloat(s, 64); f < unit.limit {
+			return s + unit.name
+		}
+	}
+
+	const (
+		second = uint64(time.Second)
+		minute = uint64(time.Minute)
+		hour   = uint64(time.Hour)
+		day    = 24 * hour
+	)
+	if n := _roundUint(ns, second); n < hour {
+		return fmt.Sprintf("%dm%ds", n/minute, n%minute/second)
+	}
+	if n := _roundUint(ns, minute); n < day {
+		return fmt.Sprintf("%dh%dm", n/hour, n%hour/minute)
+	}
+	n := _roundUint(ns, hour)
+	return fmt.Sprintf("%dd%dh", n/day, n%day/hour)
+}
+
+// _roundUint rounds n to the nearest multiple of unit (halves away from
+// zero).
+func _roundUint(n, unit uint64) uint64 {
+	return (n + unit/2) / unit * unit
+}
+
+func _formatSignificant(f float64) string {
+	decimals := 0
+	switch {
+	case f < 10:
+		decimals = 2
+	case f < 100:
+		decimals = 1
+	}
+	s := strconv.FormatFloat(f, 'f', decimals, 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+func Commas(n int) string {
+	s := strconv.Itoa(n)
+	sign := ""
+	if n < 0 {
+		sign, s = "-", s[1:]
+	}
+	var builder strings.Builder
+	builder.WriteString(sign)
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			builder.WriteByte(',')
+		}
+		builder.WriteRune(c)
+	}
+	return builder.String()
+}
+
+var _fieldSepRegex *regexp.Regexp
+
+func _ensureFields() {
+	if _fields != nil {
+		return
+	}
+	_fields = _splitFields(_record)
+}
+
+// _splitFields splits s into fields using the -F field separator.
+func _splitFields(s string) []string {
+{{if .FixedWidth}}
+	return _splitColumns(s)
+{{else if .Format}}
+	values, _ := _matchFormat(s)
+	return values
+{{else if .Logfmt}}
+	_, values := _parseLogfmt(s)
+	return values
+{{else if eq .FieldSep " "}}
+	return strings.Fields(s)
+{{else}}
+	if s == "" {
+		return []string{}
+	}
+{{if le (len .FieldSep) 1}}
+		return strings.Split(s, {{printf "%q" .FieldSep}})
+{{else}}
+		if _fieldSepRegex == nil {
+			_fieldSepRegex = regexp.MustCompile({{printf "%q" .FieldSep}})
+		}
+		return _fieldSepRegex.Split(s, -1)
+{{end}}
+{{end}}
+}
+
+// _columns are the -W column positions: pairs of start and end byte offsets,
+// with an end of -1 meaning the rest of the line. For "-W underline", they're
+// set from the underline row of dashes below the header.
+var _columns = {{.Columns}}
+
+func _splitColumns(s string) []string {
+	fields := make([]string, 0, len(_columns)/2)
+	for i := 0; i < len(_columns); i += 2 {
+		start, end := _columns[i], _columns[i+1]
+		if start > len(s) {
+			start = len(s)
+		}
+		if end < 0 || end > len(s) {
+			end = len(s)
+		}
+		field := s[_runeStart(s, start):_runeStart(s, end)]
+		if {{.TrimColumns}} {
+			field = strings.TrimSpace(field)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// _runeStart returns byte offset i in s, moved back to the start of the
+// UTF-8 character it's in, so that fields aren't split mid-character.
+func _runeStart(s string, i int) int {
+	for i > 0 && i < len(s) && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
+
+// _underlineColumns returns the column positions for a header underline row
+// like "----- ---  ------" (each column extends to the start of the next), or
+// nil if s isn't an underline row.
+func _underlineColumns(s string) []int {
+	if strings.Trim(s, "- ") != "" || !strings.Contains(s, "-") {
+		return nil
+	}
+	var columns []int
+	for i := 0; i < len(s); i++ {
+		if s[i] == '-' && (i == 0 || s[i-1] == ' ') {
+			if len(columns) > 0 {
+				columns[len(columns)-1] = i
+			}
+			columns = append(columns, i, -1)
+		}
+	}
+	return columns
+}
+
+func System(command string) int {
+	Flush()
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return _runCommand(cmd)
+}
+
+func Exec(name string, args ...string) (string, int) {
+	Flush() // so program's stderr appears after what we've printed
+	var output bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = os.Stderr
+	status := _runCommand(cmd)
+	return output.String(), status
+}
+
+// _runCommand runs cmd and returns its exit status, or 128+signal if it was
+// killed by a signal, like the shell does.
+func _runCommand(cmd *exec.Cmd) int {
+	err := cmd.Run()
+	if _, isExit := err.(*exec.ExitError); err != nil && !isExit {
+		_errorf("error running %q: %v", cmd.Args[0], err)
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return cmd.ProcessState.ExitCode()
+}
+
+// Programs started by Start: _started limits how many run at once, and
+// _startFailures counts those that exit with a non-zero status.
+var (
+	_started       chan struct{}
+	_startedWait   sync.WaitGroup
+	_startFailures int32
+)
+
+func Start(name string, args ...string) {
+	if _started == nil {
+		n := {{.Parallel}}
+		if n == 0 {
+			n = runtime.NumCPU()
+		}
+		_started = make(chan struct{}, n)
+	}
+	Flush()
+	_started <- struct{}{}
+	_startedWait.Add(1)
+	go func() {
+		defer func() {
+			<-_started
+			_startedWait.Done()
+		}()
+		var output bytes.Buffer
+		cmd := exec.Command(name, args...)
+		cmd.Stdout = &output
+		cmd.Stderr = os.Stderr
+		if _runCommand(cmd) != 0 {
+			atomic.AddInt32(&_startFailures, 1)
+		}
+		// Print all of the program's output at once so it doesn't get
+		// mixed up with other programs' output.
+		Print(output.String())
+	}()
+}
+
+// Wait waits for all programs started by Start to finish, and returns the
+// number that failed (since the last call to Wait).
+func Wait() int {
+	_startedWait.Wait()
+	return int(atomic.SwapInt32(&_startFailures, 0))
+}
+
+// The key=value pairs in the current record, parsed when first needed.
+var (
+	_kvParsed bool
+	_kvKeys   []string
+	_kvValues []string
+)
+
+{{if .Format}}
+var (
+	_formatRegex   = regexp.MustCompile({{printf "%q" .FormatRegex}})
+	_formatKeys    []string
+	_formatSkipped int
+	_formatFirstNR int
+)
+
+func init() {
+	for _, name := range _formatRegex.SubexpNames() {
+		if name != "" {
+			_formatKeys = append(_formatKeys, name)
+		}
+	}
+}
+
+// _matchFormat returns the values of the named -format fields in s, or an
+// empty slice and false if s doesn't match the format.
+func _matchFormat(s string) ([]string, bool) {
+	matches := _formatRegex.FindStringSubmatch(s)
+	if matches == nil {
+		return []string{}, false
+	}
+	values := make([]string, 0, len(_formatKeys))
+	for i, name := range _formatRegex.SubexpNames() {
+		if name != "" {
+			values = append(values, matches[i])
+		}
+	}
+	return values, true
+}
+
+// _parseFormat parses the current record with the -format regex, setting its
+// fields and key-value pairs, or counts it as skipped if it doesn't match.
+func _parseFormat() bool {
+	values, ok := _matchFormat(_record)
+	if !ok {
+		if _formatSkipped == 0 {
+			_formatFirstNR = _nr
+		}
+		_formatSkipped++
+		return false
+	}
+	_fields = values
+	_kvKeys, _kvValues, _kvParsed = _formatKeys, values, true
+	return true
+}
+{{end}}
+
+func _ensureKVs() {
+	if _kvParsed {
+		return
+	}
+	_kvKeys, _kvValues = _parseLogfmt(_record)
+	_kvParsed = true
+}
+
+// _parseLogfmt parses s as logfmt key=value pairs separated by whitespace.
+// Values may be double-quoted Go-style strings, and a key without "=" has
+// an empty value.
+func _parseLogfmt(s string) (keys, values []string) {
+	i := 0
+	for i < len(s) {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		start := i
+		for i < len(s) && s[i] != '=' && s[i] != ' ' && s[i] != '\t' {
+			i++
+		}
+		key := s[start:i]
+		value := ""
+		if i < len(s) && s[i] == '=' {
+			i++
+			start = i
+			if i < len(s) && s[i] == '"' {
+				i++
+				for i < len(s) && s[i] != '"' {
+					if s[i] == '\\' {
+						i++
+					}
+					i++
+				}
+				if i >= len(s) {
+					// Unterminated quoted value: use the rest of the record.
+					value = s[start+1:]
+					i = len(s)
+				} else {
+					i++
+					var err error
+					value, err = strconv.Unquote(s[start:i])
+					if err != nil {
+						value = s[start+1 : i-1]
+					}
+				}
+			} else {
+				for i < len(s) && s[i] != ' ' && s[i] != '\t' {
+					i++
+				}
+				value = s[start:i]
+			}
+		}
+		if key != "" {
+			keys = append(keys, key)
+			values = append(values, value)
+		}
+	}
+	return keys, values
+}
+
+// KVS returns the value of the first pair in the current record with the
+// given key, or "" if there isn't one.
+func KVS(key string) string {
+	_ensureKVs()
+	for i, k := range _kvKeys {
+		if k == key {
+			return _kvValues[i]
+		}
+	}
+	return ""
+}
+
+func KVI(key string) int {
+	s := KVS(key)
+	n, ok := _parseI(s)
+	if !ok {
+		_convError(_key(key), s, "integer")
+	}
+	return n
+}
+
+func KVF(key string) float64 {
+	s := KVS(key)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		_convError(_key(key), s, "number")
+	}
+	return f
+}
+
+func KVT(key string) time.Time {
+	s := KVS(key)
+	t, ok := _parseTime(s, "")
+	if !ok {
+		_convError(_key(key), s, "time")
+	}
+	return t
+}
+
+func _key(key string) string {
+	return "key " + strconv.Quote(key)
+}
+
+func Keys() []string {
+	_ensureKVs()
+	return append([]string(nil), _kvKeys...)
+}
+
+func Logfmt(kvs ...interface{}) string {
+	if len(kvs)%2 != 0 {
+		_errorf("Logfmt requires key-value pairs, got %d arguments", len(kvs))
+	}
+	var builder strings.Builder
+	for i := 0; i < len(kvs); i += 2 {
+		if i > 0 {
+			builder.WriteByte(' ')
+		}
+		builder.WriteString(fmt.Sprint(kvs[i]))
+		builder.WriteByte('=')
+		value := fmt.Sprint(kvs[i+1])
+		needsQuotes := strings.IndexFunc(value, func(r rune) bool {
+			return r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || !unicode.IsPrint(r)
+		})
+		if needsQuotes >= 0 {
+			value = strconv.Quote(value)
+		}
+		builder.WriteString(value)
+	}
+	return builder.String()
+}
+
+func PrintLogfmt(kvs ...interface{}) {
+	Println(Logfmt(kvs...))
+}
+
+// The current record's JSON value: the array element in -json-array mode,
+// or otherwise the record parsed as JSON when first needed.
+var (
+	_jsonParsed bool
+	_jsonValue  interface{}
+)
+
+// _jsonRecords returns a function that decodes the next element of the JSON
+// array at path in r, and makes it the current record. It streams the array,
+// so only one element is in memory at a time.
+func _jsonRecords(r io.Reader, path string) func() bool {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	started := false
+	depth := 0
+	return func() bool {
+		if !started {
+			depth = _findJSONArray(decoder, path)
+			started = true
+		}
+		if depth < 0 {
+			return false // already at end of array
+		}
+		if !decoder.More() {
+			_finishJSON(decoder, depth)
+			depth = -1
+			return false
+		}
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err != nil {
+			if atomic.LoadInt32(&_signal) != 0 {
+				return false // stopped reading input due to signal
+			}
+			_jsonError(err)
+		}
+		var compact bytes.Buffer
+		_ = json.Compact(&compact, raw)
+		_setRecord(compact.String())
+		_jsonValue = _decodeJSON(raw)
+		_jsonParsed = true
+		return true
+	}
+}
+
+// _findJSONArray reads decoder's tokens up to the start of the array at path
+// (in the format Path uses), and returns how many objects and arrays the array
+// is nested in.
+func _findJSONArray(decoder *json.Decoder, path string) int {
+	notFound := func() {
+		_errorf("path %q not found in JSON input", path)
+	}
+	parts := _splitPath(path)
+	for _, part := range parts {
+		switch _jsonToken(decoder) {
+		case json.Delim('{'):
+			for {
+				if !decoder.More() {
+					notFound()
+				}
+				if _jsonToken(decoder) == part {
+					break
+				}
+				_skipJSON(decoder)
+			}
+		case json.Delim('['):
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				notFound()
+			}
+			if n < 0 {
+				// Input is streamed, so there's no way to index from the end.
+				_errorf("index %d in -jpath %q must not be negative", n, path)
+			}
+			for i := 0; i <= n; i++ {
+				if !decoder.More() {
+					notFound()
+				}
+				if i < n {
+					_skipJSON(decoder)
+				}
+			}
+		default:
+			notFound()
+		}
+	}
+	if _jsonToken(decoder) != json.Delim('[') {
+		if path == "" {
+			_errorf("JSON input is not an array")
+		}
+		_errorf("JSON input at path %q is not an array", path)
+	}
+	return len(parts)
+}
+
+// _finishJSON reads the closing ']' of the records array and the rest of the
+// input after it, which must only close the depth objects and arrays the
+// records array is nested in.
+func _finishJSON(decoder *json.Decoder, depth int) {
+	_jsonToken(decoder)
+	for depth > 0 {
+		switch _jsonToken(decoder) {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	_, err := decoder.Token()
+	if err != io.EOF {
+		_errorf("error reading JSON: unexpected data after array")
+	}
+}
+
+func _jsonToken(decoder *json.Decoder) json.Token {
+	token, err := decoder.Token()
+	if err != nil {
+		_jsonError(err)
+	}
+	return token
+}
+
+func _skipJSON(decoder *json.Decoder) {
+	var raw json.RawMessage
+	err := decoder.Decode(&raw)
+	if err != nil {
+		_jsonError(err)
+	}
+}
+
+// _jsonError exits with an error message for err. The text and offset of
+// syntax errors vary between Go versions, so the last good record is reported
+// instead.
+func _jsonError(err error) {
+	if _, ok := err.(*json.SyntaxError); ok {
+		if _nr > 0 {
+			_errorf("error reading JSON: invalid syntax after NR %d", _nr)
+		}
+		_errorf("error reading JSON: invalid syntax")
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	_errorf("error reading JSON: %v", err)
+}
+
+func _decodeJSON(data []byte) interface{} {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+func _ensureJSON() {
+	if _jsonParsed {
+		return
+	}
+	_jsonValue = _decodeJSON([]byte(_record))
+	if _jsonValue == nil && strings.TrimSpace(_record) != "null" {
+		_convError("", _record, "JSON")
+	}
+	_jsonParsed = true
+}
+
+// _splitPath splits a path like "items.0.id" or "items[0].id" into its
+// parts.
+func _splitPath(path string) []string {
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	var parts []string
+	for _, part := range strings.Split(path, ".") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// Path returns the value at path in the current record's JSON, or nil if
+// there's no such value. Objects are map[string]interface{}, arrays are
+// []interface{}, and numbers are json.Number. Negative array indexes count
+// from the end.
+func Path(path string) interface{} {
+	_ensureJSON()
+	value := _jsonValue
+	for _, part := range _splitPath(path) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil {
+				return nil
+			}
+			if i < 0 {
+				i += len(v)
+			}
+			if i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+func PathS(path string) string {
+	switch v := Path(path).(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+func PathI(path string) int {
+	s := PathS(path)
+	n, ok := _parseI(s)
+	if !ok {
+		_convError(_path(path), s, "integer")
+	}
+	return n
+}
+
+func PathF(path string) float64 {
+	s := PathS(path)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		_convError(_path(path), s, "number")
+	}
+	return f
+}
+
+func _path(path string) string {
+	return "path " + strconv.Quote(path)
+}
+
+// Join state for -join: _joinRows maps key to row for the rows in the join
+// file, and _joinRow is the row matching the current record (nil if none).
+var (
+	_joinRows      map[string][]string
+	_joinHeader    map[string]int
+	_joinRow       []string
+	_joinUnmatched int
+)
+
+func _loadJoin(path string, keyCol int, header bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		_errorf("error opening join file: %v", err)
+	}
+	defer file.Close()
+
+	var rows [][]string
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".csv":
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		rows, err = reader.ReadAll()
+	default:
+		var lines []string
+		lines, err = _readLines(file)
+		for _, line := range lines {
+			if line == "" {
+				continue
+			}
+			if ext == ".tsv" {
+				rows = append(rows, strings.Split(line, "\t"))
+			} else {
+				rows = append(rows, _splitFields(line))
+			}
+		}
+	}
+	if err != nil {
+		_errorf("error reading join file %q: %v", path, err)
+	}
+
+	if header && len(rows) > 0 {
+		_joinHeader = make(map[string]int)
+		for i, name := range rows[0] {
+			_joinHeader[name] = i
+		}
+		rows = rows[1:]
+	}
+	// If several rows have the same key, the first one is used.
+	_joinRows = make(map[string][]string, len(rows))
+	for _, row := range rows {
+		if keyCol > len(row) {
+			continue
+		}
+		if _, ok := _joinRows[row[keyCol-1]]; !ok {
+			_joinRows[row[keyCol-1]] = row
+		}
+	}
+}
+
+// _joinRecord finds the join row matching the current record, and reports
+// whether the record should be processed in this join mode.
+func _joinRecord() bool {
+	row, matched := _joinRows[S({{.JoinKey}})]
+	_joinRow = row
+	if !matched {
+		_joinUnmatched++
+	}
+	switch {{printf "%q" .JoinMode}} {
+	case "left":
+		return true
+	case "anti":
+		return !matched
+	default:
+		return matched
+	}
+}
+
+func JS(i int) string {
+	if i < 1 || i > len(_joinRow) {
+		return ""
+	}
+	return _joinRow[i-1]
+}
+
+func JoinS(name string) string {
+	if _joinHeader == nil {
+		_errorf("JoinS requires -join file with -jheader")
+	}
+	i, ok := _joinHeader[name]
+	if !ok {
+		_errorf("JoinS: join file has no %q column", name)
+	}
+	return JS(i + 1)
+}
+
+// Lines returns the lines in the file at path.
+func Lines(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		_errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+	lines, err := _readLines(file)
+	if err != nil {
+		_errorf("error reading %q: %v", path, err)
+	}
+	return lines
+}
+
+func _readLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// ReadFields returns the lines in the file at path split into fields using
+// sep, which works like -F (so " " splits on whitespace). If sep is "", it
+// uses the -F field separator.
+func ReadFields(path, sep string) [][]string {
+	lines := Lines(path)
+	rows := make([][]string, len(lines))
+	for i, line := range lines {
+		if sep == "" {
+			rows[i] = _splitFields(line)
+		} else {
+			rows[i] = _splitFieldsSep(line, sep)
+		}
+	}
+	return rows
+}
+
+func _splitFieldsSep(s, sep string) []string {
+	switch {
+	case sep == " ":
+		return strings.Fields(s)
+	case s == "":
+		return []string{}
+	case len(sep) == 1:
+		return strings.Split(s, sep)
+	default:
+		return _reCompile(sep).Split(s, -1)
+	}
+}
+
+// The files being read by Getline, and their closers (used by Close).
+var (
+	_getlineFiles   = make(map[string]*bufio.Scanner)
+	_getlineClosers = make(map[string]io.Closer)
+)
+
+// Getline returns the next line from the file at path, opening it on the
+// first call. At the end of the file it returns "" and false.
+func Getline(path string) (string, bool) {
+	scanner, ok := _getlineFiles[path]
+	if !ok {
+		file, err := os.Open(path)
+		if err != nil {
+			_errorf("error opening file: %v", err)
+		}
+		scanner = bufio.NewScanner(file)
+		_getlineFiles[path] = scanner
+		_getlineClosers[path] = file
+	}
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			_errorf("error reading %q: %v", path, scanner.Err())
+		}
+		return "", false
+	}
+	return scanner.Text(), true
+}
+
+// Command runs command using "sh -c" and returns the lines it writes to
+// stdout. Like AWK, it ignores the command's exit status.
+func Command(command string) []string {
+	Flush() // so command's stderr appears after what we've printed
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if _, isExit := err.(*exec.ExitError); err != nil && !isExit {
+		_errorf("error running %q: %v", command, err)
+	}
+	lines, _ := _readLines(bytes.NewReader(output))
+	return lines
+}
+
+func NF() int {
+	_ensureFields()
+	return len(_fields)
+}
+
+func _setLocation(name string) {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		_errorf("invalid time zone: %v", err)
+	}
+	_location = location
+}
+
+func T(i int) time.Time {
+	s := S(i)
+	t, ok := _parseTime(s, "")
+	if !ok {
+		_convError(_field(i), s, "time")
+	}
+	return t
+}
+
+// _timeLayouts are the layouts ParseTime tries in order when auto-detecting.
+// Fractional seconds are accepted after the seconds field even when a layout
+// doesn't include them.
+var _timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"20060102",
+	"02/Jan/2006:15:04:05 -0700", // Apache/nginx access logs
+	"02/Jan/2006:15:04:05",
+	time.Stamp, // syslog
+	"2006 Jan _2 15:04:05",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.UnixDate,
+	time.RubyDate,
+	time.ANSIC,
+	time.RFC850,
+	time.RFC822Z,
+	time.RFC822,
+}
+
+func ParseTime(s, layout string) time.Time {
+	t, ok := _parseTime(s, layout)
+	if !ok {
+		_convError("", s, "time")
+	}
+	return t
+}
+
+func _parseTime(s, layout string) (time.Time, bool) {
+	if layout != "" {
+		t, err := time.ParseInLocation(layout, s, _location)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if !strings.Contains(layout, "06") && strings.Contains(layout, "Jan") {
+			t = _fixYear(t)
+		}
+		return t, true
+	}
+
+	s = strings.TrimSpace(s)
+	s = strings.Trim(s, "[]\"'")
+	if t, ok := _parseEpoch(s); ok {
+		return t, true
+	}
+	for _, layout := range _timeLayouts {
+		t, err := time.ParseInLocation(layout, s, _location)
+		if err == nil {
+			if layout == time.Stamp {
+				t = _fixYear(t)
+			}
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// _parseEpoch parses s as Unix time, in seconds (possibly fractional),
+// milliseconds, microseconds, or nanoseconds depending on its length. It
+// requires at least 9 digits before any decimal point (from 1973 onward in
+// seconds), so that years and dates like "2022" or "20220304" aren't taken
+// as times in 1970.
+func _parseEpoch(s string) (time.Time, bool) {
+	if strings.Trim(s, "0123456789.") != "" || strings.Count(s, ".") > 1 {
+		return time.Time{}, false
+	}
+	if intPart := strings.SplitN(s, ".", 2)[0]; len(intPart) < 9 {
+		return time.Time{}, false
+	}
+	if strings.Contains(s, ".") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e9))).In(_location), true
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	switch {
+	case len(s) <= 11:
+		return time.Unix(n, 0).In(_location), true
+	case len(s) <= 14:
+		return time.UnixMilli(n).In(_location), true
+	case len(s) <= 17:
+		return time.UnixMicro(n).In(_location), true
+	default:
+		return time.Unix(0, n).In(_location), true
+	}
+}
+
+// _fixYear sets the year of t, which was parsed from a layout without a year
+// (such as syslog's), to the current year, or the previous year if that
+// would put t more than a day in the future.
+func _fixYear(t time.Time) time.Time {
+	now := time.Now().In(_location)
+	fixed := t.AddDate(now.Year()-t.Year(), 0, 0)
+	if fixed.After(now.Add(24 * time.Hour)) {
+		fixed = t.AddDate(now.Year()-1-t.Year(), 0, 0)
+	}
+	return fixed
+}
+
+// Epoch returns t as Unix time in seconds, or 0 if t is the zero time.
+func Epoch(t time.Time) int {
+	if t.IsZero() {
+		return 0
+	}
+	return int(t.Unix())
+}
+
+// Bucket rounds t down to a multiple of d. Buckets are aligned to the local
+// time zone (see -tz), so 24*time.Hour buckets start at local midnight.
+func Bucket(t time.Time, d time.Duration) time.Time {
+	if d <= 0 {
+		_errorf("Bucket duration must be positive, not %s", d)
+	}
+	if t.IsZero() {
+		return t
+	}
+	t = t.In(_location)
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(d).Add(-shift)
+}
+
+// The regex builtins call a "Re" version that takes a compiled regex. Prig
+// rewrites calls that use a string literal regex to call these directly
+// with a regex compiled once at startup.
+
+func Match(re, s string) bool {
+	return _matchRe(_reCompile(re), s)
+}
+
+func _matchRe(regex *regexp.Regexp, s string) bool {
+	return regex.MatchString(s)
+}
+
+func Replace(re, s, repl string) string {
+	return _replaceRe(_reCompile(re), s, repl)
+}
+
+func _replaceRe(regex *regexp.Regexp, s, repl string) string {
+	return regex.ReplaceAllString(s, repl)
+}
+
+func Submatches(re, s string) []string {
+	return _submatchesRe(_reCompile(re), s)
+}
+
+func _submatchesRe(regex *regexp.Regexp, s string) []string {
+	matches := regex.FindStringSubmatch(s)
+	if matches == nil {
+		return nil
+	}
+	return matches[1:]
+}
+
+// NamedMatches returns a map of the named groups, (?P<name>re), in the
+// first match of re in s, or nil if there's no match.
+func NamedMatches(re, s string) map[string]string {
+	return _namedMatchesRe(_reCompile(re), s)
+}
+
+func _namedMatchesRe(regex *regexp.Regexp, s string) map[string]string {
+	matches := regex.FindStringSubmatch(s)
+	if matches == nil {
+		return nil
+	}
+	named := make(map[string]string)
+	for i, name := range regex.SubexpNames() {
+		if name != "" {
+			named[name] = matches[i]
+		}
+	}
+	return named
+}
+
+// AllMatches returns every match of re in s, each as a slice of the entire
+// match followed by its submatches.
+func AllMatches(re, s string) [][]string {
+	return _allMatchesRe(_reCompile(re), s)
+}
+
+func _allMatchesRe(regex *regexp.Regexp, s string) [][]string {
+	return regex.FindAllStringSubmatch(s, -1)
+}
+
+func ReplaceFunc(re, s string, repl func(string) string) string {
+	return _replaceFuncRe(_reCompile(re), s, repl)
+}
+
+func _replaceFuncRe(regex *regexp.Regexp, s string, repl func(string) string) string {
+	return regex.ReplaceAllStringFunc(s, repl)
+}
+
+func Split(re, s string) []string {
+	return _splitRe(_reCompile(re), s)
+}
+
+func _splitRe(regex *regexp.Regexp, s string) []string {
+	return regex.Split(s, -1)
+}
+
+// _reCache is an LRU cache of the regexes compiled by _reCompile (string
+// literal regexes are compiled once up front and don't use it).
+var _reCache = struct {
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // of *_reEntry, most recently used first
+	hits    int
+	misses  int
+}{
+	size:    {{.RegexCache}},
+	entries: make(map[string]*list.Element),
+	order:   list.New(),
+}
+
+type _reEntry struct {
+	re    string
+	regex *regexp.Regexp
+}
+
+func _reCompile(re string) *regexp.Regexp {
+	if elem, ok := _reCache.entries[re]; ok {
+		_reCache.hits++
+		_reCache.order.MoveToFront(elem)
+		return elem.Value.(*_reEntry).regex
+	}
+	_reCache.misses++
+	regex, err := regexp.Compile(re)
+	if err != nil {
+		_errorf("invalid regex %q: %v", re, err)
+	}
+	if _reCache.size <= 0 {
+		return regex
+	}
+	if _reCache.order.Len() >= _reCache.size {
+		oldest := _reCache.order.Back()
+		_reCache.order.Remove(oldest)
+		delete(_reCache.entries, oldest.Value.(*_reEntry).re)
+	}
+	_reCache.entries[re] = _reCache.order.PushFront(&_reEntry{re, regex})
+	return regex
+}
+
+func Substr(s string, n int, ms ...int) string {
+	n, m := _substrBounds(len(s), n, ms, "Substr")
+	return s[n:m]
+}
+
+// RSubstr is like Substr, but n and m are rune (character) indexes rather
+// than byte indexes, so it won't split multi-byte UTF-8 characters.
+func RSubstr(s string, n int, ms ...int) string {
+	runes := []rune(s)
+	n, m := _substrBounds(len(runes), n, ms, "RSubstr")
+	return string(runes[n:m])
+}
+
+func _substrBounds(length int, n int, ms []int, name string) (int, int) {
+	var m int
+	switch len(ms) {
+	case 0:
+		m = length
+	case 1:
+		m = ms[0]
+	default:
+		_errorf("%s takes 2 or 3 arguments, not %d", name, len(ms)+2)
+	}
+
+	if n < 0 {
+		n = length + n
+		if n < 0 {
+			n = 0
+		}
+	}
+	if n > length {
+		n = length
+	}
+
+	if m < 0 {
+		m = length + m
+		if m < 0 {
+			m = 0
+		}
+	}
+	if m > length {
+		m = length
+	}
+
+	if n > m {
+		return n, n
+	}
+
+	return n, m
+}
+
+func RuneLen(s string) int {
+	return utf8.RuneCountInString(s)
+}
+
+// Width returns the display width of s in a terminal: East Asian wide
+// characters take two columns, and combining and control characters none.
+func Width(s string) int {
+	width := 0
+	for _, r := range s {
+		width += _runeWidth(r)
+	}
+	return width
+}
+
+// Pad pads s with spaces to the given display width, aligning it left, or
+// right if width is negative. It returns s as is if it's already as wide.
+func Pad(s string, width int) string {
+	alignRight := width < 0
+	if alignRight {
+		width = -width
+	}
+	padding := width - Width(s)
+	if padding <= 0 {
+		return s
+	}
+	if alignRight {
+		return strings.Repeat(" ", padding) + s
+	}
+	return s + strings.Repeat(" ", padding)
+}
+
+// Truncate shortens s to at most the given display width, ending it with
+// ellipsis (for example "…") if it was truncated.
+func Truncate(s string, width int, ellipsis string) string {
+	if Width(s) <= width {
+		return s
+	}
+	ellipsisWidth := Width(ellipsis)
+	if ellipsisWidth > width {
+		ellipsis = ""
+		ellipsisWidth = 0
+	}
+	used := 0
+	for i, r := range s {
+		w := _runeWidth(r)
+		if used+w > width-ellipsisWidth {
+			return s[:i] + ellipsis
+		}
+		used += w
+	}
+	return s
+}
+
+func _runeWidth(r rune) int {
+	switch {
+	case r < 0x20 || (r >= 0x7f && r < 0xa0):
+		return 0
+	case r < 0x300:
+		return 1
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case r < _wideRanges[0]:
+		return 1
+	}
+	// Binary search the sorted (lo, hi) pairs of wide ranges
+	i := sort.Search(len(_wideRanges)/2, func(i int) bool {
+		return _wideRanges[2*i+1] >= r
+	})
+	if i < len(_wideRanges)/2 && _wideRanges[2*i] <= r {
+		return 2
+	}
+	return 1
+}
+
+// East Asian Wide and Fullwidth ranges (and wide emoji), as lo, hi pairs.
+var _wideRanges = []rune{
+	0x1100, 0x115f, 0x231a, 0x231b, 0x2329, 0x232a, 0x23e9, 0x23ec,
+	0x23f0, 0x23f0, 0x23f3, 0x23f3, 0x25fd, 0x25fe, 0x2614, 0x2615,
+	0x2648, 0x2653, 0x267f, 0x267f, 0x2693, 0x2693, 0x26a1, 0x26a1,
+	0x26aa, 0x26ab, 0x26bd, 0x26be, 0x26c4, 0x26c5, 0x26ce, 0x26ce,
+	0x26d4, 0x26d4, 0x26ea, 0x26ea, 0x26f2, 0x26f3, 0x26f5, 0x26f5,
+	0x26fa, 0x26fa, 0x26fd, 0x26fd, 0x2705, 0x2705, 0x270a, 0x270b,
+	0x2728, 0x2728, 0x274c, 0x274c, 0x274e, 0x274e, 0x2753, 0x2755,
+	0x2757, 0x2757, 0x2795, 0x2797, 0x27b0, 0x27b0, 0x27bf, 0x27bf,
+	0x2b1b, 0x2b1c, 0x2b50, 0x2b50, 0x2b55, 0x2b55, 0x2e80, 0x303e,
+	0x3041, 0x33ff, 0x3400, 0x4dbf, 0x4e00, 0x9fff, 0xa000, 0xa4cf,
+	0xa960, 0xa97f, 0xac00, 0xd7a3, 0xf900, 0xfaff, 0xfe10, 0xfe19,
+	0xfe30, 0xfe6f, 0xff00, 0xff60, 0xffe0, 0xffe6, 0x16fe0, 0x16fe4,
+	0x17000, 0x18aff, 0x1b000, 0x1b2ff, 0x1f004, 0x1f004, 0x1f0cf, 0x1f0cf,
+	0x1f18e, 0x1f18e, 0x1f191, 0x1f19a, 0x1f200, 0x1f202, 0x1f210, 0x1f23b,
+	0x1f240, 0x1f248, 0x1f250, 0x1f251, 0x1f260, 0x1f265, 0x1f300, 0x1f64f,
+	0x1f680, 0x1f6ff, 0x1f7e0, 0x1f7eb, 0x1f900, 0x1f9ff, 0x1fa70, 0x1faff,
+	0x20000, 0x2fffd, 0x30000, 0x3fffd,
+}
+
+type _sortOption int
+
+const (
+	Reverse _sortOption = iota
+	ByValue
+	Natural
+	Numeric
+)
+
+// _stringOrder is how strings are compared when sorting.
+type _stringOrder int
+
+const (
+	_lexical _stringOrder = iota
+	_natural
+	_numeric
+)
+
+func _getSortOptions(options ..._sortOption) (reverse bool, order _stringOrder) {
+	for _, option := range options {
+		switch option {
+		case Reverse:
+			reverse = true
+		case ByValue:
+			_errorf("Sort option ByValue not valid")
+		case Natural, Numeric:
+			order = _getStringOrder(order, option, "Sort")
+		default:
+			_errorf("Sort option %d not valid", option)
+		}
+	}
+	return reverse, order
+}
+
+func _getSortMapOptions(options ..._sortOption) (reverse, byValue bool, order _stringOrder) {
+	for _, option := range options {
+		switch option {
+		case Reverse:
+			reverse = true
+		case ByValue:
+			byValue = true
+		case Natural, Numeric:
+			order = _getStringOrder(order, option, "SortMap")
+		default:
+			_errorf("SortMap option %d not valid", option)
+		}
+	}
+	return reverse, byValue, order
+}
+
+func _getStringOrder(order _stringOrder, option _sortOption, name string) _stringOrder {
+	newOrder := _natural
+	if option == Numeric {
+		newOrder = _numeric
+	}
+	if order != _lexical && order != newOrder {
+		_errorf("%s options Natural and Numeric not valid together", name)
+	}
+	return newOrder
+}
+
+func _compareStrings(a, b string, order _stringOrder) int {
+	switch order {
+	case _natural:
+		return _naturalCompare(a, b)
+	case _numeric:
+		return _numericCompare(a, b)
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// _compare compares two int, float64, or string values, returning -1, 0,
+// or 1. Values of different types are ordered by type name.
+func _compare(a, b interface{}, order _stringOrder) int {
+	switch a := a.(type) {
+	case int:
+		if b, ok := b.(int); ok {
+			return _compareInts(a < b, a > b)
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			return _compareInts(a < b, a > b)
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return _compareStrings(a, b, order)
+		}
+	default:
+		_errorf("sort key type must be int, float64, or string, not %T", a)
+	}
+	return strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b))
+}
+
+func _compareInts(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// _naturalCompare compares strings with runs of digits compared by their
+// numeric value, so that "file2" comes before "file10".
+func _naturalCompare(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if _isDigit(a[i]) && _isDigit(b[j]) {
+			startA, startB := i, j
+			for i < len(a) && _isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && _isDigit(b[j]) {
+				j++
+			}
+			digitsA := strings.TrimLeft(a[startA:i], "0")
+			digitsB := strings.TrimLeft(b[startB:j], "0")
+			if len(digitsA) != len(digitsB) {
+				if len(digitsA) < len(digitsB) {
+					return -1
+				}
+				return 1
+			}
+			if c := strings.Compare(digitsA, digitsB); c != 0 {
+				return c
+			}
+			continue
+		}
+		if a[i] != b[j] {
+			if a[i] < b[j] {
+				return -1
+			}
+			return 1
+		}
+		i++
+		j++
+	}
+	switch {
+	case i < len(a):
+		return 1
+	case j < len(b):
+		return -1
+	default:
+		// Equal apart from leading zeros
+		return strings.Compare(a, b)
+	}
+}
+
+func _isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// _numericCompare compares strings by numeric value. Strings that aren't
+// numbers come after numbers, and are compared as strings.
+func _numericCompare(a, b string) int {
+	floatA, errA := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	floatB, errB := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	switch {
+	case errA == nil && errB == nil:
+		if floatA < floatB {
+			return -1
+		}
+		if floatA > floatB {
+			return 1
+		}
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// Like Percentile, but s must already be sorted.
+func _percentile(s []float64, p float64) float64 {
+	if !(p >= 0 && p <= 100) {
+		_errorf("Percentile p must be between 0 and 100, not %g", p)
+	}
+	if len(s) == 0 {
+		return math.NaN()
+	}
+	rank := p / 100 * float64(len(s)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return s[lo] + (rank-float64(lo))*(s[hi]-s[lo])
+}
+
+func _mean(s []float64) float64 {
+	if len(s) == 0 {
+		return math.NaN()
+	}
+	sum := 0.0
+	for _, x := range s {
+		sum += x
+	}
+	return sum / float64(len(s))
+}
+
+func _stdDev(s []float64) float64 {
+	mean := _mean(s)
+	sum := 0.0
+	for _, x := range s {
+		sum += (x - mean) * (x - mean)
+	}
+	return math.Sqrt(sum / float64(len(s)))
+}
+
+// TDigest estimates quantiles of a stream of values using a bounded amount
+// of memory (a merging t-digest). The zero value is ready to use.
+type TDigest struct {
+	centroids []_centroid // merged centroids, sorted by mean
+	buffer    []_centroid // values added since the last merge
+	count     float64
+	min, max  float64
+}
+
+type _centroid struct {
+	mean   float64
+	weight float64
+}
+
+const _tdigestCompression = 100
+
+func NewTDigest() *TDigest {
+	return &TDigest{}
+}
+
+func (d *TDigest) Add(x float64) {
+	if d.count == 0 || x < d.min {
+		d.min = x
+	}
+	if d.count == 0 || x > d.max {
+		d.max = x
+	}
+	d.count++
+	d.buffer = append(d.buffer, _centroid{x, 1})
+	if len(d.buffer) >= 5*_tdigestCompression {
+		d.compress()
+	}
+}
+
+// Merge adds all the values from other to d, for example to combine
+// digests computed separately.
+func (d *TDigest) Merge(other *TDigest) {
+	if other.count == 0 {
+		return
+	}
+	if d.count == 0 || other.min < d.min {
+		d.min = other.min
+	}
+	if d.count == 0 || other.max > d.max {
+		d.max = other.max
+	}
+	d.count += other.count
+	d.buffer = append(d.buffer, other.centroids...)
+	d.buffer = append(d.buffer, other.buffer...)
+	d.compress()
+}
+
+func (d *TDigest) Count() int {
+	return int(d.count)
+}
+
+// Quantile returns the estimated q quantile (q from 0 to 1) of the values
+// added, or NaN if none have been added.
+func (d *TDigest) Quantile(q float64) float64 {
+	if !(q >= 0 && q <= 1) {
+		_errorf("Quantile q must be between 0 and 1, not %g", q)
+	}
+	if d.count == 0 {
+		return math.NaN()
+	}
+	d.compress()
+	c := d.centroids
+	index := q * d.count
+	if index < c[0].weight/2 {
+		return d.min + index/(c[0].weight/2)*(c[0].mean-d.min)
+	}
+	center := c[0].weight / 2
+	for i := 0; i < len(c)-1; i++ {
+		delta := (c[i].weight + c[i+1].weight) / 2
+		if center+delta > index {
+			return c[i].mean + (index-center)/delta*(c[i+1].mean-c[i].mean)
+		}
+		center += delta
+	}
+	last := c[len(c)-1]
+	if index >= d.count || last.weight == 0 {
+		return d.max
+	}
+	return last.mean + (index-center)/(last.weight/2)*(d.max-last.mean)
+}
+
+// compress merges the buffered values into the centroids, keeping
+// centroids small near the tails so extreme quantiles stay accurate.
+func (d *TDigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := append(d.centroids, d.buffer...)
+	d.buffer = d.buffer[:0]
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].mean < all[j].mean
+	})
+
+	n := 0
+	current := all[0]
+	soFar := 0.0
+	limit := d.count * _tdigestLimit(0)
+	for _, c := range all[1:] {
+		if soFar+current.weight+c.weight <= limit {
+			current.weight += c.weight
+			current.mean += (c.mean - current.mean) * c.weight / current.weight
+			continue
+		}
+		soFar += current.weight
+		all[n] = current
+		n++
+		limit = d.count * _tdigestLimit(soFar/d.count)
+		current = c
+	}
+	all[n] = current
+	d.centroids = all[:n+1]
+}
+
+// _tdigestLimit returns the largest quantile a centroid starting at
+// quantile q may extend to (using the t-digest k1 scale function).
+func _tdigestLimit(q float64) float64 {
+	k := _tdigestCompression/(2*math.Pi)*math.Asin(2*q-1) + 1
+	if k >= _tdigestCompression/4 {
+		return 1
+	}
+	return (math.Sin(2*math.Pi*k/_tdigestCompression) + 1) / 2
+}
+
+// Quantiles returns a map of the estimated q quantile of each digest, for
+// reporting with SortMap.
+func Quantiles(digests map[string]*TDigest, q float64) map[string]float64 {
+	result := make(map[string]float64, len(digests))
+	for k, d := range digests {
+		result[k] = d.Quantile(q)
+	}
+	return result
+}
+
+// DistinctCounter estimates the number of distinct strings added using a
+// HyperLogLog sketch (16KB, about 1% error). The zero value is ready to use.
+type DistinctCounter struct {
+	registers []uint8
+}
+
+const _hllBits = 14
+
+func NewDistinctCounter() *DistinctCounter {
+	return &DistinctCounter{}
+}
+
+func (c *DistinctCounter) Add(s string) {
+	if c.registers == nil {
+		c.registers = make([]uint8, 1<<_hllBits)
+	}
+	hash := _hashString(s)
+	index := hash >> (64 - _hllBits)
+	rank := uint8(bits.LeadingZeros64(hash<<_hllBits|1<<(_hllBits-1)) + 1)
+	if rank > c.registers[index] {
+		c.registers[index] = rank
+	}
+}
+
+// Merge adds all the strings counted by other to c, for example to combine
+// counters computed separately.
+func (c *DistinctCounter) Merge(other *DistinctCounter) {
+	if other.registers == nil {
+		return
+	}
+	if c.registers == nil {
+		c.registers = make([]uint8, 1<<_hllBits)
+	}
+	for i, rank := range other.registers {
+		if rank > c.registers[i] {
+			c.registers[i] = rank
+		}
+	}
+}
+
+// Estimate returns the estimated number of distinct strings added. It uses
+// Otmar Ertl's "improved raw estimator", which (unlike the original
+// HyperLogLog estimate) needs no empirical bias correction.
+func (c *DistinctCounter) Estimate() int {
+	if c.registers == nil {
+		return 0
+	}
+	const maxRank = 64 - _hllBits + 1
+	var counts [maxRank + 1]int
+	for _, rank := range c.registers {
+		counts[rank]++
+	}
+	m := float64(len(c.registers))
+	z := m * _hllTau(1-float64(counts[maxRank])/m)
+	for k := maxRank - 1; k >= 1; k-- {
+		z = 0.5 * (z + float64(counts[k]))
+	}
+	z += m * _hllSigma(float64(counts[0])/m)
+	return int(m*m/(2*math.Ln2*z) + 0.5)
+}
+
+func _hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+func _hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// Estimates returns a map of the estimate of each counter, for reporting
+// with SortMap.
+func Estimates(counters map[string]*DistinctCounter) map[string]int {
+	result := make(map[string]int, len(counters))
+	for k, c := range counters {
+		result[k] = c.Estimate()
+	}
+	return result
+}
+
+// _hashString returns the 64-bit FNV-1a hash of s, mixed with the
+// MurmurHash3 finalizer so all bits are well distributed.
+func _hashString(s string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint64(s[i])
+		hash *= 1099511628211
+	}
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+// Group aggregates metrics for groups of records that share one or more key
+// values, for example g.Key(S(1), S(2)).Add("bytes", F(3)).
+type Group struct {
+	names   []string // names of key columns
+	metrics []string // metric names, in the order first added
+	rows    map[string]*GroupRow
+}
+
+// GroupRow holds the metrics for one group in a Group.
+type GroupRow struct {
+	Keys  []interface{}
+	Count int // number of times Key returned this row
+	stats map[string]*Stat
+	group *Group
+}
+
+// Stat tracks the count, sum, minimum, and maximum of the values added.
+type Stat struct {
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+func (s *Stat) Add(x float64) {
+	if s.Count == 0 || x < s.Min {
+		s.Min = x
+	}
+	if s.Count == 0 || x > s.Max {
+		s.Max = x
+	}
+	s.Count++
+	s.Sum += x
+}
+
+// Mean returns the mean of the values added, or NaN if there are none.
+func (s *Stat) Mean() float64 {
+	if s.Count == 0 {
+		return math.NaN()
+	}
+	return s.Sum / float64(s.Count)
+}
+
+// NewGroup returns a new Group with the given key column names (used as
+// Report headings).
+func NewGroup(names ...string) *Group {
+	return &Group{names: names, rows: make(map[string]*GroupRow)}
+}
+
+// Key returns the row for the given key values, creating it if needed, and
+// increments the row's Count.
+func (g *Group) Key(keys ...interface{}) *GroupRow {
+	if len(g.names) > 0 && len(keys) != len(g.names) {
+		_errorf("Group Key requires %d values, not %d", len(g.names), len(keys))
+	}
+	key := _groupKey(keys)
+	row := g.rows[key]
+	if row == nil {
+		row = &GroupRow{Keys: keys, stats: make(map[string]*Stat), group: g}
+		g.rows[key] = row
+	}
+	row.Count++
+	return row
+}
+
+// _groupKey returns a map key for the given key values. It includes each
+// value's type, so that int 1 and string "1" are different groups, and each
+// string's length, so that strings containing the separator can't collide.
+func _groupKey(keys []interface{}) string {
+	var builder strings.Builder
+	for _, key := range keys {
+		switch key := key.(type) {
+		case string:
+			builder.WriteString("s")
+			builder.WriteString(strconv.Itoa(len(key)))
+			builder.WriteByte(':')
+			builder.WriteString(key)
+		case int:
+			builder.WriteString("i")
+			builder.WriteString(strconv.Itoa(key))
+		default:
+			s := fmt.Sprint(key)
+			fmt.Fprintf(&builder, "%T %d:%s", key, len(s), s)
+		}
+		builder.WriteByte(0)
+	}
+	return builder.String()
+}
+
+// Add adds x to the named metric in this row, and returns the row so calls
+// can be chained.
+func (r *GroupRow) Add(metric string, x float64) *GroupRow {
+	stat := r.stats[metric]
+	if stat == nil {
+		stat = &Stat{}
+		r.stats[metric] = stat
+		if !_contains(r.group.metrics, metric) {
+			r.group.metrics = append(r.group.metrics, metric)
+		}
+	}
+	stat.Add(x)
+	return r
+}
+
+// Stat returns the named metric's Stat (empty if nothing has been added).
+func (r *GroupRow) Stat(metric string) *Stat {
+	stat := r.stats[metric]
+	if stat == nil {
+		return &Stat{}
+	}
+	return stat
+}
+
+// Rows returns the group's rows sorted by key; options are as for SortMap,
+// with ByValue sorting by Count.
+func (g *Group) Rows(options ..._sortOption) []*GroupRow {
+	reverse, byValue, order := _getSortMapOptions(options...)
+	rows := make([]*GroupRow, 0, len(g.rows))
+	for _, row := range g.rows {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		c := _compareGroupKeys(rows[i].Keys, rows[j].Keys, order)
+		if byValue {
+			if countC := _compareInts(rows[i].Count < rows[j].Count, rows[i].Count > rows[j].Count); countC != 0 {
+				c = countC
+			}
+		}
+		if reverse {
+			return c > 0
+		}
+		return c < 0
+	})
+	return rows
+}
+
+// _compareGroupKeys compares two rows' keys element by element. Keys that
+// aren't int, float64, or string are compared as formatted strings.
+func _compareGroupKeys(a, b []interface{}, order _stringOrder) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		c := _compare(_groupSortKey(a[i]), _groupSortKey(b[i]), order)
+		if c != 0 {
+			return c
+		}
+	}
+	return _compareInts(len(a) < len(b), len(a) > len(b))
+}
+
+func _groupSortKey(key interface{}) interface{} {
+	switch key.(type) {
+	case int, float64, string:
+		return key
+	default:
+		return fmt.Sprint(key)
+	}
+}
+
+// Report prints a table of the group's rows (sorted as per Rows) with the
+// keys, count, and the sum, min, max, and mean of each metric.
+func (g *Group) Report(options ..._sortOption) {
+	var buf bytes.Buffer
+	writer := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	rows := g.Rows(options...)
+	numKeys := len(g.names)
+	if numKeys == 0 && len(rows) > 0 {
+		numKeys = len(rows[0].Keys)
+	}
+	for i := 0; i < numKeys; i++ {
+		if i < len(g.names) {
+			fmt.Fprintf(writer, "%s\t", g.names[i])
+		} else {
+			fmt.Fprintf(writer, "key%d\t", i+1)
+		}
+	}
+	fmt.Fprint(writer, "count")
+	for _, metric := range g.metrics {
+		fmt.Fprintf(writer, "\t%s_sum\t%s_min\t%s_max\t%s_mean", metric, metric, metric, metric)
+	}
+	fmt.Fprintln(writer)
+	for _, row := range rows {
+		for _, key := range row.Keys {
+			fmt.Fprintf(writer, "%v\t", key)
+		}
+		fmt.Fprint(writer, row.Count)
+		for _, metric := range g.metrics {
+			stat := row.stats[metric]
+			if stat == nil {
+				fmt.Fprint(writer, "\t-\t-\t-\t-")
+				continue
+			}
+			fmt.Fprintf(writer, "\t%s\t%s\t%s\t%s", _formatStat(stat.Sum),
+				_formatStat(stat.Min), _formatStat(stat.Max), _formatStat(stat.Mean()))
+		}
+		fmt.Fprintln(writer)
+	}
+	writer.Flush()
+	Print(buf.String())
+}
+
+func _formatStat(x float64) string {
+	return strconv.FormatFloat(math.Round(x*1e6)/1e6, 'f', -1, 64)
+}
+
+func _contains(s []string, x string) bool {
+	for _, elem := range s {
+		if elem == x {
+			return true
+		}
+	}
+	return false
+}
+
+type _chartOption int
 
 const (
-	Reverse _sortOption = iota
-	ByValue
+	LogScale _chartOption = iota
 )
 
-func _getSortOptions(options ..._sortOption) (reverse bool) {
+func _getChartOptions(name string, options ..._chartOption) (logScale bool) {
 	for _, option := range options {
 		switch option {
-		case Reverse:
-			reverse = true
-		case ByValue:
-			_errorf("Sort option ByValue not valid")
+		case LogScale:
+			logScale = true
 		default:
-			_errorf("Sort option %d valid", option)
+			_errorf("%s option %d not valid", name, option)
 		}
 	}
-	return reverse
+	return logScale
 }
 
-func _getSortMapOptions(options ..._sortOption) (reverse, byValue bool) {
-	for _, option := range options {
-		switch option {
-		case Reverse:
-			reverse = true
-		case ByValue:
-			byValue = true
+// _histogram prints a bar chart of the counts of values in the buckets
+// between edges (the last bucket includes its upper edge), with extra rows
+// for values outside the edges, if any.
+func _histogram(values, edges []float64, logScale bool) {
+	counts := make([]int, len(edges)-1)
+	below, above, nans := 0, 0, 0
+	for _, x := range values {
+		switch {
+		case math.IsNaN(x):
+			nans++
+		case x < edges[0]:
+			below++
+		case x > edges[len(edges)-1]:
+			above++
 		default:
-			_errorf("SortMap option %d not valid", option)
+			i := sort.SearchFloat64s(edges, x) // first edge >= x
+			if i == len(edges) || edges[i] != x || i == len(edges)-1 {
+				i-- // x is in the bucket before edges[i], or the last bucket
+			}
+			counts[i]++
+		}
+	}
+
+	var labels []string
+	var barValues []float64
+	var valueStrs []string
+	addRow := func(label string, count int) {
+		labels = append(labels, label)
+		barValues = append(barValues, float64(count))
+		valueStrs = append(valueStrs, strconv.Itoa(count))
+	}
+	if below > 0 {
+		addRow("< "+_formatEdge(edges[0]), below)
+	}
+	for i, count := range counts {
+		closing := ")"
+		if i == len(counts)-1 {
+			closing = "]"
+		}
+		addRow("["+_formatEdge(edges[i])+", "+_formatEdge(edges[i+1])+closing, count)
+	}
+	if above > 0 {
+		addRow("> "+_formatEdge(edges[len(edges)-1]), above)
+	}
+	if nans > 0 {
+		addRow("NaN", nans)
+	}
+	_printBars(labels, barValues, valueStrs, logScale)
+}
+
+// _histogramEdges returns the edges of n equal-width buckets from the
+// minimum to the maximum of the finite values (nil if there are none).
+func _histogramEdges(values []float64, n int) []float64 {
+	if n < 1 {
+		_errorf("Histogram requires at least 1 bucket, not %d", n)
+	}
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, x := range values {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			continue // counted in the NaN, below, or above rows
+		}
+		min = math.Min(min, x)
+		max = math.Max(max, x)
+	}
+	if min > max {
+		return nil
+	}
+	if min == max {
+		return []float64{min, max}
+	}
+	edges := make([]float64, n+1)
+	width := max/float64(n) - min/float64(n) // max-min may overflow
+	for i := range edges {
+		edges[i] = min + width*float64(i)
+	}
+	edges[n] = max // avoid rounding error
+	return edges
+}
+
+func _checkEdges(edges []float64) {
+	if len(edges) < 2 {
+		_errorf("HistogramEdges requires at least 2 edges")
+	}
+	for i, edge := range edges {
+		if math.IsNaN(edge) || math.IsInf(edge, 0) {
+			_errorf("HistogramEdges edges must be finite")
+		}
+		if i > 0 && edge <= edges[i-1] {
+			_errorf("HistogramEdges edges must be increasing")
+		}
+	}
+}
+
+// _formatEdge formats a bucket edge rounded to 4 significant digits.
+func _formatEdge(x float64) string {
+	if x == 0 || math.IsInf(x, 0) || math.IsNaN(x) {
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	scale := math.Pow(10, 3-math.Floor(math.Log10(math.Abs(x))))
+	return strconv.FormatFloat(math.Round(x*scale)/scale, 'f', -1, 64)
+}
+
+// _printBars prints rows of label, value, and a horizontal bar scaled so
+// that the longest bar fits in the terminal width.
+func _printBars(labels []string, values []float64, valueStrs []string, logScale bool) {
+	labelWidth, valueWidth := 0, 0
+	max := 0.0
+	for i := range labels {
+		labelWidth = _maxInt(labelWidth, Width(labels[i]))
+		valueWidth = _maxInt(valueWidth, Width(valueStrs[i]))
+		if scaled := _barScale(values[i], logScale); !math.IsInf(scaled, 1) {
+			max = math.Max(max, scaled)
+		}
+	}
+	barWidth := _maxInt(_terminalWidth()-labelWidth-valueWidth-4, 10)
+	for i := range labels {
+		scaled := _barScale(values[i], logScale)
+		bar := ""
+		switch {
+		case math.IsInf(scaled, 1):
+			bar = _bar(float64(barWidth)) // full width for +Inf
+		case max > 0:
+			bar = _bar(scaled / max * float64(barWidth))
+		}
+		line := Pad(labels[i], labelWidth) + "  " + Pad(valueStrs[i], -valueWidth) + "  " + bar
+		Println(strings.TrimRight(line, " "))
+	}
+}
+
+func _barScale(x float64, logScale bool) float64 {
+	if !(x > 0) {
+		return 0
+	}
+	if logScale {
+		return math.Log1p(x)
+	}
+	return x
+}
+
+// _bar returns a bar of the given length in characters, using eighth
+// blocks for the fractional part (and at least one eighth if length > 0).
+func _bar(length float64) string {
+	eighths := int(math.Round(length * 8))
+	if eighths == 0 && length > 0 {
+		eighths = 1
+	}
+	bar := strings.Repeat("█", eighths/8)
+	if eighths%8 > 0 {
+		bar += string([]rune(" ▏▎▍▌▋▊▉")[eighths%8])
+	}
+	return bar
+}
+
+func _terminalWidth() int {
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width <= 0 {
+		return 80
+	}
+	return width
+}
+
+func _maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Sparkline returns a string of block characters with heights scaled from
+// the minimum to the maximum finite value (NaN values are spaces, and
+// infinite values are the lowest or highest block).
+func Sparkline(values []float64) string {
+	const blocks = "▁▂▃▄▅▆▇█"
+	levels := []rune(blocks)
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, x := range values {
+		if !math.IsNaN(x) && !math.IsInf(x, 0) {
+			min = math.Min(min, x)
+			max = math.Max(max, x)
+		}
+	}
+	var builder strings.Builder
+	for _, x := range values {
+		switch {
+		case math.IsNaN(x):
+			builder.WriteByte(' ')
+		case math.IsInf(x, -1):
+			builder.WriteRune(levels[0])
+		case math.IsInf(x, 1):
+			builder.WriteRune(levels[len(levels)-1])
+		case max == min:
+			builder.WriteRune(levels[len(levels)/2])
+		default:
+			// Halve values so that max-min can't overflow.
+			fraction := (x/2 - min/2) / (max/2 - min/2)
+			level := int(math.Round(fraction * float64(len(levels)-1)))
+			builder.WriteRune(levels[level])
+		}
+	}
+	return builder.String()
+}
+
+var (
+	_metricFamilies  = make(map[string]*_metricFamily)
+	_metricNameRegex = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+	_labelNameRegex  = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	_defaultBuckets  = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+type _metricFamily struct {
+	name    string
+	help    string
+	kind    string // "counter", "gauge", or "histogram"
+	buckets []float64
+	metrics map[string]*Metric // keyed by formatted labels
+}
+
+// Metric is a Prometheus counter, gauge, or histogram with a particular set
+// of labels.
+type Metric struct {
+	family *_metricFamily
+	labels []string // label name-value pairs, sorted by name
+	value  float64
+	counts []int // histogram count per bucket (not cumulative)
+	sum    float64
+	count  int
+}
+
+func PromCounter(name, help string, labels ...string) *Metric {
+	return _getMetric(name, help, "counter", nil, labels)
+}
+
+func PromGauge(name, help string, labels ...string) *Metric {
+	return _getMetric(name, help, "gauge", nil, labels)
+}
+
+func PromHistogram(name, help string, buckets []float64, labels ...string) *Metric {
+	if buckets == nil {
+		buckets = _defaultBuckets
+	}
+	return _getMetric(name, help, "histogram", buckets, labels)
+}
+
+func _getMetric(name, help, kind string, buckets []float64, labels []string) *Metric {
+	family := _metricFamilies[name]
+	if family == nil {
+		if !_metricNameRegex.MatchString(name) {
+			_errorf("invalid Prometheus metric name %q", name)
+		}
+		family = &_metricFamily{
+			name:    name,
+			help:    help,
+			kind:    kind,
+			buckets: _histogramBuckets(name, buckets),
+			metrics: make(map[string]*Metric),
+		}
+		_metricFamilies[name] = family
+	} else if family.kind != kind {
+		_errorf("Prometheus metric %q is a %s, not a %s", name, family.kind, kind)
+	} else if kind == "histogram" && !_sameBuckets(family.buckets, _histogramBuckets(name, buckets)) {
+		_errorf("Prometheus histogram %q buckets differ from earlier call", name)
+	}
+
+	if len(labels)%2 != 0 {
+		_errorf("Prometheus metric %q labels must be name-value pairs", name)
+	}
+	pairs := make([][2]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		if !_labelNameRegex.MatchString(labels[i]) || labels[i] == "le" && kind == "histogram" {
+			_errorf("invalid Prometheus label name %q", labels[i])
+		}
+		pairs = append(pairs, [2]string{labels[i], labels[i+1]})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	sorted := make([]string, 0, len(labels))
+	for i, pair := range pairs {
+		if i > 0 && pair[0] == pairs[i-1][0] {
+			_errorf("duplicate Prometheus label name %q for metric %q", pair[0], name)
+		}
+		sorted = append(sorted, pair[0], pair[1])
+	}
+	key := _formatLabels(sorted, "")
+	metric := family.metrics[key]
+	if metric == nil {
+		metric = &Metric{family: family, labels: sorted}
+		if kind == "histogram" {
+			metric.counts = make([]int, len(family.buckets))
+		}
+		family.metrics[key] = metric
+	}
+	return metric
+}
+
+// _histogramBuckets returns a sorted copy of buckets without duplicates or
+// +Inf (the +Inf bucket is always written).
+func _histogramBuckets(name string, buckets []float64) []float64 {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	result := sorted[:0]
+	for i, bound := range sorted {
+		switch {
+		case math.IsNaN(bound):
+			_errorf("Prometheus histogram %q bucket must not be NaN", name)
+		case math.IsInf(bound, 1) || i > 0 && bound == sorted[i-1]:
+			continue
+		}
+		result = append(result, bound)
+	}
+	return result
+}
+
+func _sameBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Inc adds 1 to a counter or gauge.
+func (m *Metric) Inc() {
+	m.Add(1)
+}
+
+// Add adds x to a counter or gauge (x must not be negative for counters).
+func (m *Metric) Add(x float64) {
+	switch {
+	case m.family.kind == "histogram":
+		_errorf("can't Add to Prometheus histogram %q (use Observe)", m.family.name)
+	case m.family.kind == "counter" && x < 0:
+		_errorf("can't Add negative value to Prometheus counter %q", m.family.name)
+	}
+	m.value += x
+}
+
+// Set sets a gauge to x.
+func (m *Metric) Set(x float64) {
+	if m.family.kind != "gauge" {
+		_errorf("can't Set Prometheus %s %q", m.family.kind, m.family.name)
+	}
+	m.value = x
+}
+
+// Observe adds x to a histogram.
+func (m *Metric) Observe(x float64) {
+	if m.family.kind != "histogram" {
+		_errorf("can't Observe Prometheus %s %q", m.family.kind, m.family.name)
+	}
+	i := sort.SearchFloat64s(m.family.buckets, x) // first bucket with x <= upper bound
+	if i < len(m.counts) {
+		m.counts[i]++
+	}
+	m.sum += x
+	m.count++
+}
+
+// _formatLabels formats label name-value pairs (plus an "le" label if le
+// isn't "") in Prometheus text format, like {method="GET",code="200"}.
+func _formatLabels(labels []string, le string) string {
+	if le != "" {
+		labels = append(labels[:len(labels):len(labels)], "le", le)
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	var builder strings.Builder
+	builder.WriteByte('{')
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		builder.WriteString(labels[i])
+		builder.WriteString("=\"")
+		builder.WriteString(_labelEscaper.Replace(labels[i+1]))
+		builder.WriteByte('"')
+	}
+	builder.WriteByte('}')
+	return builder.String()
+}
+
+var (
+	_labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+	_helpEscaper  = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+)
+
+func _formatMetricValue(x float64) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "+Inf"
+	case math.IsInf(x, -1):
+		return "-Inf"
+	case math.IsNaN(x):
+		return "NaN"
+	}
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+// _formatMetrics returns the metrics in Prometheus text exposition format,
+// sorted by name and then labels.
+func _formatMetrics() string {
+	var builder strings.Builder
+	names := make([]string, 0, len(_metricFamilies))
+	for name := range _metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := _metricFamilies[name]
+		if family.help != "" {
+			fmt.Fprintf(&builder, "# HELP %s %s\n", name, _helpEscaper.Replace(family.help))
+		}
+		fmt.Fprintf(&builder, "# TYPE %s %s\n", name, family.kind)
+		keys := make([]string, 0, len(family.metrics))
+		for key := range family.metrics {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			metric := family.metrics[key]
+			if family.kind != "histogram" {
+				fmt.Fprintf(&builder, "%s%s %s\n", name, key, _formatMetricValue(metric.value))
+				continue
+			}
+			cumulative := 0
+			for i, bound := range family.buckets {
+				cumulative += metric.counts[i]
+				fmt.Fprintf(&builder, "%s_bucket%s %d\n",
+					name, _formatLabels(metric.labels, _formatMetricValue(bound)), cumulative)
+			}
+			fmt.Fprintf(&builder, "%s_bucket%s %d\n", name, _formatLabels(metric.labels, "+Inf"), metric.count)
+			fmt.Fprintf(&builder, "%s_sum%s %s\n", name, key, _formatMetricValue(metric.sum))
+			fmt.Fprintf(&builder, "%s_count%s %d\n", name, key, metric.count)
 		}
 	}
-	return reverse, byValue
+	return builder.String()
+}
+
+// _writeMetrics writes the metrics to stdout if path is "-", otherwise it
+// writes them to a temporary file and renames it to path, so that readers
+// (such as node_exporter's textfile collector) never see a partial file.
+func _writeMetrics(path string) {
+	text := _formatMetrics()
+	if path == "-" {
+		Print(text)
+		return
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		_errorf("error writing metrics: %v", err)
+	}
+	_, err = file.WriteString(text)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		_errorf("error writing metrics: %v", err)
+	}
 }
 
-{{.SortFuncs}}
+{{.GenericFuncs}}
 
 func _errorf(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
@@ -568,50 +4216,80 @@ func _errorf(format string, args ...interface{}) {
 
 const sortGeneric = `
 func Sort[T int|float64|string](s []T, options ..._sortOption) []T {
-	reverse := _getSortOptions(options...)
+	reverse, order := _getSortOptions(options...)
 
-	// TODO: probably could be improved when slices package arrives
 	result := make([]T, len(s))
 	copy(result, s)
-	if reverse {
-		sort.Slice(result, func(i, j int) bool {
-			return result[i] > result[j]
+	switch {
+	case order != _lexical:
+		_sortSlice(result, func(a, b T) bool {
+			return _compareValues(a, b, order) < 0 != reverse
 		})
-	} else {
-		sort.Slice(result, func(i, j int) bool {
-			return result[i] < result[j]
+	case reverse:
+		_sortSlice(result, func(a, b T) bool {
+			return a > b
+		})
+	default:
+		_sortSlice(result, func(a, b T) bool {
+			return a < b
 		})
 	}
 	return result
 }
 
+type _ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64 | ~string
+}
+
 type KV[T int|float64|string] struct {
 	K string
 	V T
 }
 
+// SortMap returns the sorted key-value pairs of m. For maps with other key
+// types, use SortPairs.
 func SortMap[T int|float64|string](m map[string]T, options ..._sortOption) []KV[T] {
-	reverse, byValue := _getSortMapOptions(options...)
+	pairs := SortPairs(m, options...)
+	kvs := make([]KV[T], len(pairs))
+	for i, pair := range pairs {
+		kvs[i] = KV[T]{pair.K, pair.V}
+	}
+	return kvs
+}
+
+// Pair is a key-value pair returned by SortPairs.
+type Pair[K _ordered, V int|float64|string] struct {
+	K K
+	V V
+}
 
-	kvs := make([]KV[T], 0, len(m))
+// SortPairs returns the sorted key-value pairs of m, which may have any
+// ordered key type.
+func SortPairs[K _ordered, V int|float64|string](m map[K]V, options ..._sortOption) []Pair[K, V] {
+	reverse, byValue, order := _getSortMapOptions(options...)
+
+	kvs := make([]Pair[K, V], 0, len(m))
 	for k, v := range m {
-		kvs = append(kvs, KV[T]{k, v})
+		kvs = append(kvs, Pair[K, V]{k, v})
 	}
 
-	// TODO: probably could be improved when slices package arrives
 	if byValue {
-		sort.Slice(kvs, func (i, j int) bool {
-			if kvs[i].V == kvs[j].V {
-				return kvs[i].K < kvs[j].K
+		_sortSlice(kvs, func (a, b Pair[K, V]) bool {
+			c := _compareValues(a.V, b.V, order)
+			if c == 0 {
+				return _compareValues(a.K, b.K, order) < 0
 			}
-			return kvs[i].V < kvs[j].V
+			return c < 0
 		})
 	} else {
-		sort.Slice(kvs, func (i, j int) bool {
-			if kvs[i].K == kvs[j].K {
-				return kvs[i].V < kvs[j].V
+		_sortSlice(kvs, func (a, b Pair[K, V]) bool {
+			c := _compareValues(a.K, b.K, order)
+			if c == 0 {
+				return _compareValues(a.V, b.V, order) < 0
 			}
-			return kvs[i].K < kvs[j].K
+			return c < 0
 		})
 	}
 
@@ -624,11 +4302,120 @@ func SortMap[T int|float64|string](m map[string]T, options ..._sortOption) []KV[
 	}
 	return kvs
 }
+
+// _compareValues returns -1, 0, or 1 depending on whether a is less than,
+// equal to, or greater than b, using order if they're strings.
+func _compareValues[T _ordered](a, b T, order _stringOrder) int {
+	if order != _lexical {
+		// Use reflect so that named string types are compared this way too.
+		if valueA := reflect.ValueOf(a); valueA.Kind() == reflect.String {
+			return _compareStrings(valueA.String(), reflect.ValueOf(b).String(), order)
+		}
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// SortBy returns a new slice sorted by the key of each element.
+func SortBy[T any, K int|float64|string](s []T, key func(T) K, options ..._sortOption) []T {
+	reverse, order := _getSortOptions(options...)
+
+	// Call key once per element, not once per comparison
+	pairs := make([]_keyed[K, T], len(s))
+	for i, elem := range s {
+		pairs[i] = _keyed[K, T]{key(elem), elem}
+	}
+	_sortSlice(pairs, func(a, b _keyed[K, T]) bool {
+		c := _compareValues(a.key, b.key, order)
+		if reverse {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	result := make([]T, len(s))
+	for i, pair := range pairs {
+		result[i] = pair.elem
+	}
+	return result
+}
+
+// _keyed is an element and its sort key. It's not declared inside SortBy,
+// as Go 1.18 and 1.19 don't support type declarations in generic functions.
+type _keyed[K, T any] struct {
+	key  K
+	elem T
+}
+
+// SortFunc returns a new slice sorted using the given less function.
+func SortFunc[T any](s []T, less func(a, b T) bool, options ..._sortOption) []T {
+	reverse, order := _getSortOptions(options...)
+	if order != _lexical {
+		_errorf("SortFunc options Natural and Numeric not valid")
+	}
+
+	result := make([]T, len(s))
+	copy(result, s)
+	if reverse {
+		_sortSlice(result, func(a, b T) bool {
+			return less(b, a)
+		})
+	} else {
+		_sortSlice(result, less)
+	}
+	return result
+}
+
+// SortKey compares two elements by one key; create with Asc or Desc.
+type SortKey[T any] func(a, b T) int
+
+func Asc[T any, K int|float64|string](key func(T) K) SortKey[T] {
+	return func(a, b T) int {
+		return _compareValues(key(a), key(b), _lexical)
+	}
+}
+
+func Desc[T any, K int|float64|string](key func(T) K) SortKey[T] {
+	asc := Asc(key)
+	return func(a, b T) int {
+		return asc(b, a)
+	}
+}
+
+// SortKeys returns a new slice sorted by the first key, then the second
+// key for elements where the first is equal, and so on.
+func SortKeys[T any](s []T, keys ...SortKey[T]) []T {
+	result := make([]T, len(s))
+	copy(result, s)
+	_sortSlice(result, func(a, b T) bool {
+		for _, key := range keys {
+			if c := key(a, b); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return result
+}
+
+// _sortSlice sorts s using less, keeping equal elements in their original
+// order. This is what the slices package does, but that needs Go 1.21.
+func _sortSlice[T any](s []T, less func(a, b T) bool) {
+	sort.SliceStable(s, func(i, j int) bool {
+		return less(s[i], s[j])
+	})
+}
 `
 
 const sortNonGeneric = `
 func Sort(s interface{}, options ..._sortOption) []interface{} {
-	reverse := _getSortOptions(options...)
+	reverse, order := _getSortOptions(options...)
 
 	var result []interface{}
 	switch s := s.(type) {
@@ -651,7 +4438,9 @@ func Sort(s interface{}, options ..._sortOption) []interface{} {
 	case []string:
 		cp := make([]string, len(s))
 		copy(cp, s)
-		sort.Strings(cp)
+		sort.SliceStable(cp, func(i, j int) bool {
+			return _compareStrings(cp[i], cp[j], order) < 0
+		})
 		result = make([]interface{}, len(s))
 		for i, x := range cp {
 			result[i] = x
@@ -675,8 +4464,18 @@ type KV struct {
 	V interface{}
 }
 
+// Pair is the same as KV without generics, as keys can only be strings.
+type Pair = KV
+
+// SortPairs is the same as SortMap without generics.
+func SortPairs(m interface{}, options ..._sortOption) []Pair {
+	return SortMap(m, options...)
+}
+
+// SortMap returns the sorted key-value pairs of m, which must have string
+// keys (without generics, KV.K can only be a string).
 func SortMap(m interface{}, options ..._sortOption) []KV {
-	reverse, byValue := _getSortMapOptions(options...)
+	reverse, byValue, order := _getSortMapOptions(options...)
 
 	var kvs []KV
 	var vLess func(i, j int) bool
@@ -703,16 +4502,16 @@ func SortMap(m interface{}, options ..._sortOption) []KV {
 			kvs = append(kvs, KV{k, v})
 		}
 		vLess = func(i, j int) bool {
-			return kvs[i].V.(string) < kvs[j].V.(string)
+			return _compareStrings(kvs[i].V.(string), kvs[j].V.(string), order) < 0
 		}
 	default:
-		_errorf("SortMap values must be int, float64, or string")
+		_errorf("SortMap type must be map[string]T with T int, float64, or string")
 	}
 
 	if byValue {
 		sort.Slice(kvs, func (i, j int) bool {
 			if kvs[i].V == kvs[j].V {
-				return kvs[i].K < kvs[j].K
+				return _compareStrings(kvs[i].K, kvs[j].K, order) < 0
 			}
 			return vLess(i, j)
 		})
@@ -721,7 +4520,7 @@ func SortMap(m interface{}, options ..._sortOption) []KV {
 			if kvs[i].K == kvs[j].K {
 				return vLess(i, j)
 			}
-			return kvs[i].K < kvs[j].K
+			return _compareStrings(kvs[i].K, kvs[j].K, order) < 0
 		})
 	}
 
@@ -734,4 +4533,548 @@ func SortMap(m interface{}, options ..._sortOption) []KV {
 	}
 	return kvs
 }
+
+// SortBy returns a new slice sorted by the key of each element. The result
+// has the same type as s, but must be converted with a type assertion.
+func SortBy(s interface{}, key interface{}, options ..._sortOption) interface{} {
+	reverse, order := _getSortOptions(options...)
+	value := _sliceValue(s, "SortBy")
+	keyFunc := _funcValue(key, 1, "SortBy key")
+
+	// Call key once per element, not once per comparison
+	keys := make([]interface{}, value.Len())
+	for i := range keys {
+		keys[i] = keyFunc.Call([]reflect.Value{value.Index(i)})[0].Interface()
+	}
+	return _sortIndexes(value, func(i, j int) bool {
+		if reverse {
+			return _compare(keys[i], keys[j], order) > 0
+		}
+		return _compare(keys[i], keys[j], order) < 0
+	})
+}
+
+// SortFunc returns a new slice sorted using the given less function. The
+// result must be converted with a type assertion.
+func SortFunc(s interface{}, less interface{}, options ..._sortOption) interface{} {
+	reverse, order := _getSortOptions(options...)
+	if order != _lexical {
+		_errorf("SortFunc options Natural and Numeric not valid")
+	}
+	value := _sliceValue(s, "SortFunc")
+	lessFunc := _funcValue(less, 2, "SortFunc less")
+	return _sortIndexes(value, func(i, j int) bool {
+		if reverse {
+			i, j = j, i
+		}
+		return lessFunc.Call([]reflect.Value{value.Index(i), value.Index(j)})[0].Bool()
+	})
+}
+
+// SortKey compares elements by one key; create with Asc or Desc.
+type SortKey struct {
+	key  reflect.Value
+	desc bool
+}
+
+func Asc(key interface{}) SortKey {
+	return SortKey{_funcValue(key, 1, "Asc key"), false}
+}
+
+func Desc(key interface{}) SortKey {
+	return SortKey{_funcValue(key, 1, "Desc key"), true}
+}
+
+// SortKeys returns a new slice sorted by the first key, then the second
+// key for elements where the first is equal, and so on. The result must be
+// converted with a type assertion.
+func SortKeys(s interface{}, keys ...SortKey) interface{} {
+	value := _sliceValue(s, "SortKeys")
+	keyValues := make([][]interface{}, len(keys))
+	for k, key := range keys {
+		keyValues[k] = make([]interface{}, value.Len())
+		for i := range keyValues[k] {
+			keyValues[k][i] = key.key.Call([]reflect.Value{value.Index(i)})[0].Interface()
+		}
+	}
+	return _sortIndexes(value, func(i, j int) bool {
+		for k, key := range keys {
+			c := _compare(keyValues[k][i], keyValues[k][j], _lexical)
+			if key.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// _sortIndexes returns a sorted copy of the given slice, where less
+// compares elements by their index in the original slice.
+func _sortIndexes(value reflect.Value, less func(i, j int) bool) interface{} {
+	indexes := make([]int, value.Len())
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return less(indexes[i], indexes[j])
+	})
+	result := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+	for i, index := range indexes {
+		result.Index(i).Set(value.Index(index))
+	}
+	return result.Interface()
+}
+
+func _sliceValue(s interface{}, name string) reflect.Value {
+	value := reflect.ValueOf(s)
+	if value.Kind() != reflect.Slice {
+		_errorf("%s requires a slice, not %T", name, s)
+	}
+	return value
+}
+
+func _funcValue(f interface{}, numIn int, name string) reflect.Value {
+	value := reflect.ValueOf(f)
+	if value.Kind() != reflect.Func || value.Type().NumIn() != numIn || value.Type().NumOut() != 1 {
+		_errorf("%s must be a function with %d argument(s) and 1 result, not %T", name, numIn, f)
+	}
+	return value
+}
+
+`
+
+const statsGeneric = `
+func Sum[T int|float64](s []T) T {
+	var sum T
+	for _, x := range s {
+		sum += x
+	}
+	return sum
+}
+
+func Min[T int|float64](s []T) T {
+	if len(s) == 0 {
+		return 0
+	}
+	min := s[0]
+	for _, x := range s[1:] {
+		if x < min {
+			min = x
+		}
+	}
+	return min
+}
+
+func Max[T int|float64](s []T) T {
+	if len(s) == 0 {
+		return 0
+	}
+	max := s[0]
+	for _, x := range s[1:] {
+		if x > max {
+			max = x
+		}
+	}
+	return max
+}
+
+func Mean[T int|float64](s []T) float64 {
+	return _mean(_toFloats(s))
+}
+
+func Median[T int|float64](s []T) float64 {
+	return Percentile(s, 50)
+}
+
+func Percentile[T int|float64](s []T, p float64) float64 {
+	floats := _toFloats(s)
+	sort.Float64s(floats)
+	return _percentile(floats, p)
+}
+
+func StdDev[T int|float64](s []T) float64 {
+	return _stdDev(_toFloats(s))
+}
+
+func _toFloats[T int|float64](s []T) []float64 {
+	floats := make([]float64, len(s))
+	for i, x := range s {
+		floats[i] = float64(x)
+	}
+	return floats
+}
+`
+
+const statsNonGeneric = `
+func Sum(s interface{}) float64 {
+	sum := 0.0
+	for _, x := range _toFloats(s, "Sum") {
+		sum += x
+	}
+	return sum
+}
+
+func Min(s interface{}) float64 {
+	floats := _toFloats(s, "Min")
+	if len(floats) == 0 {
+		return 0
+	}
+	min := floats[0]
+	for _, x := range floats[1:] {
+		if x < min {
+			min = x
+		}
+	}
+	return min
+}
+
+func Max(s interface{}) float64 {
+	floats := _toFloats(s, "Max")
+	if len(floats) == 0 {
+		return 0
+	}
+	max := floats[0]
+	for _, x := range floats[1:] {
+		if x > max {
+			max = x
+		}
+	}
+	return max
+}
+
+func Mean(s interface{}) float64 {
+	return _mean(_toFloats(s, "Mean"))
+}
+
+func Median(s interface{}) float64 {
+	floats := _toFloats(s, "Median")
+	sort.Float64s(floats)
+	return _percentile(floats, 50)
+}
+
+func Percentile(s interface{}, p float64) float64 {
+	floats := _toFloats(s, "Percentile")
+	sort.Float64s(floats)
+	return _percentile(floats, p)
+}
+
+func StdDev(s interface{}) float64 {
+	return _stdDev(_toFloats(s, "StdDev"))
+}
+
+func _toFloats(s interface{}, name string) []float64 {
+	switch s := s.(type) {
+	case []int:
+		floats := make([]float64, len(s))
+		for i, x := range s {
+			floats[i] = float64(x)
+		}
+		return floats
+	case []float64:
+		floats := make([]float64, len(s))
+		copy(floats, s)
+		return floats
+	default:
+		_errorf("%s type must be int or float64", name)
+		return nil
+	}
+}
+`
+
+const counterGeneric = `
+// Counter counts occurrences of keys. The zero value is ready to use.
+type Counter[K int|float64|string] struct {
+	counts map[K]int
+	total  int
+}
+
+// Count is a key and its count, as returned by Counter.Top and Bottom.
+type Count[K int|float64|string] struct {
+	K K
+	N int
+}
+
+func (c *Counter[K]) Inc(key K) {
+	c.Add(key, 1)
+}
+
+func (c *Counter[K]) Add(key K, n int) {
+	if c.counts == nil {
+		c.counts = make(map[K]int)
+	}
+	c.counts[key] += n
+	c.total += n
+}
+
+func (c *Counter[K]) Get(key K) int {
+	return c.counts[key]
+}
+
+// Len returns the number of distinct keys.
+func (c *Counter[K]) Len() int {
+	return len(c.counts)
+}
+
+// Total returns the sum of all counts.
+func (c *Counter[K]) Total() int {
+	return c.total
+}
+
+// Top returns the k most frequent keys, most frequent first (ties are
+// ordered by key).
+func (c *Counter[K]) Top(k int) []Count[K] {
+	return _topCounts(c.counts, k, false)
+}
+
+// Bottom returns the k least frequent keys, least frequent first (ties are
+// ordered by key).
+func (c *Counter[K]) Bottom(k int) []Count[K] {
+	return _topCounts(c.counts, k, true)
+}
+
+// _topCounts uses a heap of size k to find the first k counts, which is a
+// lot faster than sorting all of them when k is small.
+func _topCounts[K int|float64|string](counts map[K]int, k int, bottom bool) []Count[K] {
+	h := &_countHeap[K]{bottom: bottom}
+	if k <= 0 {
+		return h.counts
+	}
+	for key, n := range counts {
+		c := Count[K]{key, n}
+		if len(h.counts) < k {
+			heap.Push(h, c)
+		} else if h.before(c, h.counts[0]) {
+			h.counts[0] = c
+			heap.Fix(h, 0)
+		}
+	}
+	result := h.counts
+	sort.Slice(result, func(i, j int) bool {
+		return h.before(result[i], result[j])
+	})
+	return result
+}
+
+// _countHeap is a heap with the count that would be output last at the root.
+type _countHeap[K int|float64|string] struct {
+	counts []Count[K]
+	bottom bool
+}
+
+func (h *_countHeap[K]) before(a, b Count[K]) bool {
+	if a.N != b.N {
+		return (a.N > b.N) != h.bottom
+	}
+	return a.K < b.K
+}
+
+func (h *_countHeap[K]) Len() int           { return len(h.counts) }
+func (h *_countHeap[K]) Less(i, j int) bool { return h.before(h.counts[j], h.counts[i]) }
+func (h *_countHeap[K]) Swap(i, j int)      { h.counts[i], h.counts[j] = h.counts[j], h.counts[i] }
+func (h *_countHeap[K]) Push(x interface{}) { h.counts = append(h.counts, x.(Count[K])) }
+
+func (h *_countHeap[K]) Pop() interface{} {
+	x := h.counts[len(h.counts)-1]
+	h.counts = h.counts[:len(h.counts)-1]
+	return x
+}
+`
+
+const counterNonGeneric = `
+// Counter counts occurrences of keys. The zero value is ready to use.
+type Counter struct {
+	counts map[interface{}]int
+	total  int
+}
+
+// Count is a key and its count, as returned by Counter.Top and Bottom.
+type Count struct {
+	K interface{}
+	N int
+}
+
+func (c *Counter) Inc(key interface{}) {
+	c.Add(key, 1)
+}
+
+func (c *Counter) Add(key interface{}, n int) {
+	switch key.(type) {
+	case int, float64, string:
+	default:
+		_errorf("Counter key type must be int, float64, or string")
+	}
+	if c.counts == nil {
+		c.counts = make(map[interface{}]int)
+	}
+	c.counts[key] += n
+	c.total += n
+}
+
+func (c *Counter) Get(key interface{}) int {
+	return c.counts[key]
+}
+
+// Len returns the number of distinct keys.
+func (c *Counter) Len() int {
+	return len(c.counts)
+}
+
+// Total returns the sum of all counts.
+func (c *Counter) Total() int {
+	return c.total
+}
+
+// Top returns the k most frequent keys, most frequent first (ties are
+// ordered by key).
+func (c *Counter) Top(k int) []Count {
+	return _topCounts(c.counts, k, false)
+}
+
+// Bottom returns the k least frequent keys, least frequent first (ties are
+// ordered by key).
+func (c *Counter) Bottom(k int) []Count {
+	return _topCounts(c.counts, k, true)
+}
+
+// _topCounts uses a heap of size k to find the first k counts, which is a
+// lot faster than sorting all of them when k is small.
+func _topCounts(counts map[interface{}]int, k int, bottom bool) []Count {
+	h := &_countHeap{bottom: bottom}
+	if k <= 0 {
+		return h.counts
+	}
+	for key, n := range counts {
+		c := Count{key, n}
+		if len(h.counts) < k {
+			heap.Push(h, c)
+		} else if h.before(c, h.counts[0]) {
+			h.counts[0] = c
+			heap.Fix(h, 0)
+		}
+	}
+	result := h.counts
+	sort.Slice(result, func(i, j int) bool {
+		return h.before(result[i], result[j])
+	})
+	return result
+}
+
+// _countHeap is a heap with the count that would be output last at the root.
+type _countHeap struct {
+	counts []Count
+	bottom bool
+}
+
+func (h *_countHeap) before(a, b Count) bool {
+	if a.N != b.N {
+		return (a.N > b.N) != h.bottom
+	}
+	return _compare(a.K, b.K, _lexical) < 0
+}
+
+func (h *_countHeap) Len() int           { return len(h.counts) }
+func (h *_countHeap) Less(i, j int) bool { return h.before(h.counts[j], h.counts[i]) }
+func (h *_countHeap) Swap(i, j int)      { h.counts[i], h.counts[j] = h.counts[j], h.counts[i] }
+func (h *_countHeap) Push(x interface{}) { h.counts = append(h.counts, x.(Count)) }
+
+func (h *_countHeap) Pop() interface{} {
+	x := h.counts[len(h.counts)-1]
+	h.counts = h.counts[:len(h.counts)-1]
+	return x
+}
+`
+
+const chartGeneric = `
+func Histogram[T int|float64](values []T, n int, options ..._chartOption) {
+	logScale := _getChartOptions("Histogram", options...)
+	floats := _toFloats(values)
+	edges := _histogramEdges(floats, n)
+	if edges != nil {
+		_histogram(floats, edges, logScale)
+	}
+}
+
+func HistogramEdges[T int|float64](values []T, edges []float64, options ..._chartOption) {
+	logScale := _getChartOptions("HistogramEdges", options...)
+	_checkEdges(edges)
+	_histogram(_toFloats(values), edges, logScale)
+}
+
+// _barEntry is a KV or Pair that BarChart can print.
+type _barEntry interface {
+	barEntry() (key, value interface{})
+}
+
+func (kv KV[T]) barEntry() (key, value interface{}) {
+	return kv.K, kv.V
+}
+
+func (pair Pair[K, V]) barEntry() (key, value interface{}) {
+	return pair.K, pair.V
+}
+
+// BarChart prints a bar chart of kvs (from SortMap or SortPairs) in order,
+// with a row for each key. Values must be int or float64.
+func BarChart[E _barEntry](kvs []E, options ..._chartOption) {
+	logScale := _getChartOptions("BarChart", options...)
+	labels := make([]string, len(kvs))
+	values := make([]float64, len(kvs))
+	valueStrs := make([]string, len(kvs))
+	for i, kv := range kvs {
+		key, value := kv.barEntry()
+		labels[i] = fmt.Sprint(key)
+		switch v := value.(type) {
+		case int:
+			values[i] = float64(v)
+		case float64:
+			values[i] = v
+		default:
+			_errorf("BarChart values must be int or float64")
+		}
+		valueStrs[i] = fmt.Sprint(value)
+	}
+	_printBars(labels, values, valueStrs, logScale)
+}
+`
+
+const chartNonGeneric = `
+func Histogram(values interface{}, n int, options ..._chartOption) {
+	logScale := _getChartOptions("Histogram", options...)
+	floats := _toFloats(values, "Histogram")
+	edges := _histogramEdges(floats, n)
+	if edges != nil {
+		_histogram(floats, edges, logScale)
+	}
+}
+
+func HistogramEdges(values interface{}, edges []float64, options ..._chartOption) {
+	logScale := _getChartOptions("HistogramEdges", options...)
+	_checkEdges(edges)
+	_histogram(_toFloats(values, "HistogramEdges"), edges, logScale)
+}
+
+// BarChart prints a bar chart of kvs in order, with a row for each key.
+// KV.V values must be int or float64.
+func BarChart(kvs []KV, options ..._chartOption) {
+	logScale := _getChartOptions("BarChart", options...)
+	labels := make([]string, len(kvs))
+	values := make([]float64, len(kvs))
+	valueStrs := make([]string, len(kvs))
+	for i, kv := range kvs {
+		labels[i] = kv.K
+		switch v := kv.V.(type) {
+		case int:
+			values[i] = float64(v)
+		case float64:
+			values[i] = v
+		default:
+			_errorf("BarChart values must be int or float64")
+		}
+		valueStrs[i] = fmt.Sprint(kv.V)
+	}
+	_printBars(labels, values, valueStrs, logScale)
+}
 `
@@ -3,16 +3,26 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 )
 
 var goExe = flag.String("goexe", "", "set to override Go executable used by Prig")
 
+// Whether Prig will use the generic versions of Sort, Counter, and so on.
+var usingGenerics bool
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	buildExe := *goExe
@@ -25,6 +35,16 @@ func TestMain(m *testing.M) {
 		fmt.Printf("error building Prig: %v", err)
 		os.Exit(1)
 	}
+	output, err := exec.Command(buildExe, "version").Output()
+	if err != nil {
+		fmt.Printf("error getting Go version: %v", err)
+		os.Exit(1)
+	}
+	matches := goVersionRegex.FindSubmatch(output)
+	if matches != nil {
+		goMinor, _ := strconv.Atoi(string(matches[1]))
+		usingGenerics = goMinor >= 18
+	}
 	os.Exit(m.Run())
 }
 
@@ -74,6 +94,22 @@ var prigTests = []test{
 		args: []string{`-b`, `Println(); Println(42, "foo")`},
 		out:  "\n42 foo\n",
 	},
+	{
+		name: "Flush()",
+		args: []string{`-b`, `Print("foo"); Flush(); Println("bar")`},
+		out:  "foobar\n",
+	},
+	{
+		name: "unbuffered -u",
+		args: []string{`-u`, `Print(S(1), ",")`},
+		in:   "a b\nc d\n",
+		out:  "a,c,",
+	},
+	{
+		name: "invalid flush interval",
+		args: []string{`-flush-interval`, `1x`, `Println()`},
+		err:  "invalid flush interval \"1x\"\n",
+	},
 	{
 		name: "NR() and S(0)",
 		args: []string{`Println(NR(), S(0))`},
@@ -128,6 +164,231 @@ var prigTests = []test{
 		in:   "\nfoo\n/v1/user/benhoyt/42/\n/user/xyz/100\n",
 		out:  "[]\n[]\n[]\n[xyz 100]\n",
 	},
+	{
+		name: "NamedMatches()",
+		args: []string{"Println(NamedMatches(`(?P<method>[A-Z]+) (?P<path>\\S+)( (\\d+))?`, S(0)))"},
+		in:   "GET /foo 200\nnothing\nPOST /bar\n",
+		out:  "map[method:GET path:/foo]\nmap[]\nmap[method:POST path:/bar]\n",
+	},
+	{
+		name: "AllMatches()",
+		args: []string{"m := AllMatches(`(\\w+)=(\\d+)`, S(0)); Println(len(m), m)"},
+		in:   "a=1 b=22 c=x d=3\nnone\n",
+		out:  "3 [[a=1 a 1] [b=22 b 22] [d=3 d 3]]\n0 []\n",
+	},
+	{
+		name: "ReplaceFunc()",
+		args: []string{"Println(ReplaceFunc(`\\d+`, S(0), func(s string) string { n, _ := strconv.Atoi(s); return strconv.Itoa(n * 2) }))"},
+		in:   "a1 b22 c\n",
+		out:  "a2 b44 c\n",
+	},
+	{
+		name: "Split()",
+		args: []string{"Printf(\"%q\\n\", Split(`\\s*[,;]\\s*`, S(0)))"},
+		in:   "a, b;c ,d\n\nx\n",
+		out:  "[\"a\" \"b\" \"c\" \"d\"]\n[\"\"]\n[\"x\"]\n",
+	},
+	{
+		name: "regex cache stats",
+		args: []string{`-stats`, `Println(Match(S(1), S(2)))`},
+		in:   "a a\nb a\na b\nb b\n",
+		out:  "true\nfalse\nfalse\ntrue\nregex cache: 2 hits, 2 misses\n",
+	},
+	{
+		name: "regex cache eviction",
+		args: []string{`-stats`, `-recache`, `2`, `Match(S(1), "")`},
+		in:   "a\nb\na\nc\na\nb\n",
+		out:  "regex cache: 2 hits, 4 misses\n",
+	},
+	{
+		name: "regex cache disabled",
+		args: []string{`-stats`, `-recache`, `0`, `Match(S(1), "")`},
+		in:   "a\na\n",
+		out:  "regex cache: 0 hits, 2 misses\n",
+	},
+	{
+		name: "invalid regex cache size",
+		args: []string{`-recache`, `x`, `Println()`},
+		err:  "invalid regex cache size \"x\"\n",
+	},
+	{
+		name: "dynamic regex",
+		args: []string{"Println(Match(S(1), S(2)), Replace(S(1), S(2), \"_\"))"},
+		in:   "a+ baab\nx y\n",
+		out:  "true b_b\nfalse y\n",
+	},
+	{
+		name: "shadowed regex builtin",
+		args: []string{"-b", "Match := func(a, b string) bool { return a == b }", "Println(Match(\"[\", S(0)))"},
+		in:   "[\nx\n",
+		out:  "true\nfalse\n",
+	},
+	{
+		name: "regex builtin shadowed by parameter",
+		args: []string{"-b", "f := func(Split func(a, b string) string) string { return Split(\"[\", \"x\") }", "-b", "Println(f(func(a, b string) string { return a + b }))"},
+		out:  "[x\n",
+	},
+	{
+		name: "MustI() and MustF()",
+		args: []string{`Println(MustI(1), MustF(2))`},
+		in:   "1 2.5\n3.7 -4\n",
+		out:  "1 2.5\n3 -4\n",
+	},
+	{
+		name: "MustI() error",
+		args: []string{`-u`, `Println(MustI(2))`},
+		in:   "a 1\nb 2x\nc 3\n",
+		err:  "1\nNR 2, field 2: invalid integer \"2x\"\n",
+	},
+	{
+		name: "MustF() error",
+		args: []string{`MustF(3)`},
+		in:   "a b\n",
+		err:  "NR 1, field 3: invalid number \"\"\n",
+	},
+	{
+		name: "strict conversions",
+		args: []string{`-strict`, `-u`, `Println(I(1) + I(2))`},
+		in:   "1 2\n3.5 4\n5 x\n6 7\n",
+		err:  "3\n7\nNR 3, field 2: invalid integer \"x\"\n",
+	},
+	{
+		name: "strict conversions Int()",
+		args: []string{`-strict`, `-u`, `-b`, `Println(Int("0x10", 0), Int("1,2", 10))`, `-b`, `Int("12", 2)`},
+		err:  "16 12\nNR 0: invalid integer \"12\"\n",
+	},
+	{
+		name: "strict conversions T()",
+		args: []string{`-strict`, `T(2)`},
+		in:   "x 2022-03-04\ny 2022-13-01\n",
+		err:  "NR 2, field 2: invalid time \"2022-13-01\"\n",
+	},
+	{
+		name: "warn conversions",
+		args: []string{`-warn`, `s += F(2) + float64(Bytes(3))`, `-b`, `s := 0.0`, `-e`, `Println(s)`},
+		in:   "a 1 1K\nb x 2K\nc 3 big\nd 4\n",
+		out:  "3080\nwarning: 3 conversion errors, first at NR 2, field 2: invalid number \"x\"\n",
+	},
+	{
+		name: "warn conversions Dur()",
+		args: []string{`-warn`, `Dur(1)`},
+		in:   "1s\n1x\n",
+		out:  "warning: 1 conversion error, first at NR 2, field 1: invalid duration \"1x\"\n",
+	},
+	{
+		name: "warn conversions none",
+		args: []string{`-warn`, `I(1)`},
+		in:   "1\n2\n",
+		out:  "",
+	},
+	{
+		name: "Bytes()",
+		args: []string{`Println(Bytes(1))`},
+		in:   "123\n1.5K\n2k\n2KB\n2KiB\n1,024\n3M\n1.5GB\n1gib\n2T\n-1K\n10x\nfoo\n\n",
+		out:  "123\n1536\n2048\n2000\n2048\n1024\n3145728\n1500000000\n1073741824\n2199023255552\n-1024\n0\n0\n0\n",
+	},
+	{
+		name: "Bytes() exponents",
+		args: []string{`-warn`, `Println(Bytes(1))`},
+		in:   "1e3\n1.5E+3k\n2e-1K\n1e\n1eb\n1e+\n",
+		out:  "1000\n1536000\n205\n1152921504606846976\n1000000000000000000\n0\n" +
+			"warning: 1 conversion error, first at NR 6, field 1: invalid size \"1e+\"\n",
+	},
+	{
+		name: "Dur()",
+		args: []string{`Println(Dur(1))`},
+		in:   "250ms\n1h2m3s\n1.5\n-2s\n10\nfoo\n",
+		out:  "250ms\n1h2m3s\n1.5s\n-2s\n10s\n0s\n",
+	},
+	{
+		name: "Int()",
+		args: []string{`Println(Int(S(1), I(2)))`},
+		in:   "0x1F 0\n0o17 0\n017 0\n0b101 0\nff 16\n1,234,567 10\n1_000 0\n-42 10\n12 2\nfoo 10\n",
+		out:  "31\n15\n15\n5\n255\n1234567\n1000\n-42\n0\n0\n",
+	},
+	{
+		name: "HumanBytes()",
+		args: []string{`Println(HumanBytes(I(1)))`},
+		in:   "0\n1023\n1024\n1536\n10239\n10241\n1048575\n1048577\n5368709120\n-2048\n",
+		out:  "0\n1023\n1.0K\n1.5K\n10K\n11K\n1.0M\n1.1M\n5.0G\n-2.0K\n",
+	},
+	{
+		name: "HumanBytes() extremes",
+		args: []string{`-b`, `Println(HumanBytes(math.MaxInt64), HumanBytes(math.MinInt64))`},
+		out:  "8.0E -8.0E\n",
+	},
+	{
+		name: "HumanDur()",
+		args: []string{`Println(HumanDur(Dur(1)))`},
+		in:   "0\n5ns\n1500ns\n2.5ms\n1234ms\n12.345s\n61s\n3725s\n50h\n-1s\n",
+		out:  "0ns\n5ns\n1.5µs\n2.5ms\n1.23s\n12.3s\n1m1s\n1h2m\n2d2h\n-1s\n",
+	},
+	{
+		name: "HumanDur() unit boundaries",
+		args: []string{`Println(HumanDur(Dur(1)))`},
+		in:   "999ns\n999999ns\n999499ns\n999999999ns\n59999ms\n59940ms\n3599500ms\n3599499ms\n86370s\n86369s\n",
+		out:  "999ns\n1ms\n999µs\n1s\n1m0s\n59.9s\n1h0m\n59m59s\n1d0h\n23h59m\n",
+	},
+	{
+		name: "HumanDur() extremes",
+		args: []string{`-b`, `Println(HumanDur(math.MaxInt64), HumanDur(math.MinInt64))`},
+		out:  "106752d0h -106752d0h\n",
+	},
+	{
+		name: "Commas()",
+		args: []string{`Println(Commas(I(1)))`},
+		in:   "0\n123\n1234\n123456\n1234567\n-1234567\n",
+		out:  "0\n123\n1,234\n123,456\n1,234,567\n-1,234,567\n",
+	},
+	{
+		name: "T()",
+		args: []string{`-tz`, `UTC`, `-F`, `|`, `t := T(1); Println(t.Format(time.RFC3339Nano), Epoch(t))`},
+		in: "2022-03-04T05:06:07+13:00\n2022-03-04T05:06:07.5Z\n2022-03-04 05:06:07\n2022-03-04\n" +
+			"[02/Jan/2006:15:04:05 -0700]\n[02/Jan/2006:15:04:05\n" +
+			"1650000000\n1650000000123\n1650000000123456\n1650000000123456789\n1650000000.25\n" +
+			"Mon, 02 Jan 2006 15:04:05 MST\n20220304\n2022\n12345678.5\nbad\n\n",
+		out: "2022-03-04T05:06:07+13:00 1646323567\n2022-03-04T05:06:07.5Z 1646370367\n" +
+			"2022-03-04T05:06:07Z 1646370367\n2022-03-04T00:00:00Z 1646352000\n" +
+			"2006-01-02T15:04:05-07:00 1136239445\n2006-01-02T15:04:05Z 1136214245\n" +
+			"2022-04-15T05:20:00Z 1650000000\n2022-04-15T05:20:00.123Z 1650000000\n" +
+			"2022-04-15T05:20:00.123456Z 1650000000\n2022-04-15T05:20:00.123456789Z 1650000000\n" +
+			"2022-04-15T05:20:00.25Z 1650000000\n2006-01-02T15:04:05Z 1136214245\n" +
+			"2022-03-04T00:00:00Z 1646352000\n0001-01-01T00:00:00Z 0\n0001-01-01T00:00:00Z 0\n" +
+			"0001-01-01T00:00:00Z 0\n0001-01-01T00:00:00Z 0\n",
+	},
+	{
+		name: "ParseTime()",
+		args: []string{
+			`-tz`, `America/New_York`,
+			`-b`, `Println(ParseTime("2022-03-04 05:06", "2006-01-02 15:04"))`,
+			`-b`, `Println(ParseTime("2022-03-04", "01/02/2006").IsZero())`,
+			`-b`, `Println(ParseTime("Jan  1 00:00:00", "").Year() == time.Now().Year())`,
+			`-b`, `future := time.Now().Add(72 * time.Hour)`,
+			`-b`, `Println(ParseTime(future.Format("Jan _2 15:04"), "Jan _2 15:04").Year() == future.Year()-1)`,
+		},
+		out: "2022-03-04 05:06:00 -0500 EST\ntrue\ntrue\ntrue\n",
+	},
+	{
+		name: "Bucket()",
+		args: []string{
+			`-tz`, `Australia/Adelaide`,
+			`-b`, `t := ParseTime("2022-03-04 05:36:07", "")`,
+			`-b`, `Println(Bucket(t, time.Hour), Bucket(t, 15*time.Minute))`,
+			`-b`, `Println(Bucket(t, 24*time.Hour), Bucket(time.Time{}, time.Hour).IsZero())`,
+		},
+		out: "2022-03-04 05:00:00 +1030 ACDT 2022-03-04 05:30:00 +1030 ACDT\n" +
+			"2022-03-04 00:00:00 +1030 ACDT true\n",
+	},
+	{
+		name: "Bucket() invalid duration",
+		args: []string{`-b`, `Bucket(time.Now(), 0)`},
+		err:  "Bucket duration must be positive, not 0s\n",
+	},
+	{
+		name: "invalid time zone",
+		args: []string{`-tz`, `Nowhere/Special`, `Println()`},
+		err:  "invalid time zone: unknown time zone Nowhere/Special\n",
+	},
 	{
 		name: "Substr()",
 		args: []string{
@@ -169,6 +430,30 @@ p
 
 `[1:],
 	},
+	{
+		name: "RSubstr() and RuneLen()",
+		args: []string{
+			`-b`, `s := "héllo, 世界"`,
+			`-b`, `Println(Substr(s, 1, 2) == "\xc3", RSubstr(s, 1, 2), RSubstr(s, -2), RSubstr(s, 7, 100), RSubstr(s, 3, 1) == "")`,
+			`-b`, `Println(len(s), RuneLen(s), RuneLen(""))`,
+		},
+		out: "true é 世界 世界 true\n14 9 0\n",
+	},
+	{
+		name: "RSubstr() too many arguments",
+		args: []string{`-b`, `Println(RSubstr("x", 1, 2, 3))`},
+		err:  "RSubstr takes 2 or 3 arguments, not 4\n",
+	},
+	{
+		name: "Width() Pad() Truncate()",
+		args: []string{
+			`-b`, `Println(Width("abc"), Width("世界"), Width("e\u0301"), Width("\t"), Width("👍"))`,
+			`-b`, `Println("[" + Pad("世界", 6) + "]", "[" + Pad("ab", -4) + "]", "[" + Pad("abcdef", 3) + "]")`,
+			`-b`, `Println(Truncate("hello世界!", 7, "…"), Truncate("hello世界!", 8, "…"), Truncate("hello", 5, "…"))`,
+			`-b`, `Println(Truncate("hello", 2, "..."), Truncate("世界", 3, ""))`,
+		},
+		out: "3 4 1 0 2\n[世界  ] [  ab] [abcdef]\nhello… hello世… hello\nhe 世\n",
+	},
 	{
 		name: "Sort() ints",
 		args: []string{
@@ -266,6 +551,248 @@ b 1
 		args: []string{`-b`, `Println(SortMap(map[string]int{"a": 1}, 42))`},
 		err:  "SortMap option 42 not valid\n",
 	},
+	{
+		name: "SortBy()",
+		args: []string{
+			`-b`, `type rec struct { name string; n int }`,
+			`-b`, `recs := []rec{{"b", 2}, {"a", 2}, {"c", 1}, {"d", 3}}`,
+			`-b`, `Println(SortBy(recs, func(r rec) int { return r.n }))`,
+			`-b`, `Println(SortBy(recs, func(r rec) int { return r.n }, Reverse))`,
+			`-b`, `Println(SortBy(recs, func(r rec) string { return r.name }), recs)`,
+			`-b`, `Println(SortBy([]string{"ccc", "a", "bb"}, func(s string) int { return len(s) }))`,
+		},
+		out: `
+[{c 1} {b 2} {a 2} {d 3}]
+[{d 3} {b 2} {a 2} {c 1}]
+[{a 2} {b 2} {c 1} {d 3}] [{b 2} {a 2} {c 1} {d 3}]
+[a bb ccc]
+`[1:],
+	},
+	{
+		name: "SortFunc()",
+		args: []string{
+			`-b`, `s := []float64{2.5, -1, 3, 0}`,
+			`-b`, `Println(SortFunc(s, func(a, b float64) bool { return math.Abs(a) < math.Abs(b) }))`,
+			`-b`, `Println(SortFunc(s, func(a, b float64) bool { return a < b }, Reverse))`,
+		},
+		out: "[0 -1 2.5 3]\n[3 2.5 0 -1]\n",
+	},
+	{
+		name: "SortKeys()",
+		args: []string{
+			`-b`, `type rec struct { name string; n int }`,
+			`-b`, `recs := []rec{{"b", 2}, {"a", 2}, {"c", 1}, {"d", 3}, {"a", 1}}`,
+			`-b`, `byN, byName := func(r rec) int { return r.n }, func(r rec) string { return r.name }`,
+			`-b`, `Println(SortKeys(recs, Desc(byN), Asc(byName)))`,
+			`-b`, `Println(SortKeys(recs, Asc(byName), Desc(byN)))`,
+			`-b`, `Println(SortKeys(recs))`,
+		},
+		out: `
+[{d 3} {a 2} {b 2} {a 1} {c 1}]
+[{a 2} {a 1} {b 2} {c 1} {d 3}]
+[{b 2} {a 2} {c 1} {d 3} {a 1}]
+`[1:],
+	},
+	{
+		name: "SortBy() invalid option",
+		args: []string{`-b`, `Println(SortBy([]int{4, 2}, func(x int) int { return x }, ByValue))`},
+		err:  "Sort option ByValue not valid\n",
+	},
+	{
+		name: "Sum() Min() Max()",
+		args: []string{
+			`-b`, `Println(Sum([]int{}), Min([]int{}), Max([]int{}))`,
+			`-b`, `Println(Sum([]int{3, 1, 2}), Min([]int{3, 1, 2}), Max([]int{3, 1, 2}))`,
+			`-b`, `Println(Sum([]float64{0.5, -2, 1}), Min([]float64{0.5, -2, 1}), Max([]float64{0.5, -2, 1}))`,
+		},
+		out: "0 0 0\n6 1 3\n-0.5 -2 1\n",
+	},
+	{
+		name: "Mean() Median() StdDev()",
+		args: []string{
+			`-b`, `Println(Mean([]int{}), Median([]int{}), StdDev([]int{}))`,
+			`-b`, `Println(Mean([]int{1, 2}), Median([]int{10, 1, 3}), Median([]int{4, 1, 3, 2}))`,
+			`-b`, `Println(Mean([]float64{2, 4, 4, 4, 5, 5, 7, 9}), StdDev([]float64{2, 4, 4, 4, 5, 5, 7, 9}))`,
+		},
+		out: "NaN NaN NaN\n1.5 3 2.5\n5 2\n",
+	},
+	{
+		name: "Percentile()",
+		args: []string{
+			`-b`, `s := []int{5, 1, 4, 2, 3}`,
+			`-b`, `Println(Percentile(s, 0), Percentile(s, 25), Percentile(s, 90), Percentile(s, 100))`,
+			`-b`, `Println(Percentile([]float64{}, 50), Percentile([]float64{7}, 99))`,
+		},
+		out: "1 2 4.6 5\nNaN 7\n",
+	},
+	{
+		name: "Percentile() invalid p",
+		args: []string{`-b`, `Println(Percentile([]int{1}, 101))`},
+		err:  "Percentile p must be between 0 and 100, not 101\n",
+	},
+	{
+		name: "Percentile() NaN p",
+		args: []string{`-b`, `Println(Percentile([]float64{1, 2}, math.NaN()))`},
+		err:  "Percentile p must be between 0 and 100, not NaN\n",
+	},
+	{
+		name: "TDigest",
+		args: []string{
+			`-b`, `var d TDigest; Println(d.Quantile(0.5), d.Count())`,
+			`-b`, `for i := 1; i <= 100000; i++ { d.Add(float64(i)) }`,
+			`-b`, `Println(d.Quantile(0), d.Quantile(0.5), d.Quantile(1), d.Count())`,
+			`-b`, `Println(math.Abs(d.Quantile(0.99)-99000) < 100, math.Abs(d.Quantile(0.001)-100) < 10)`,
+		},
+		out: "NaN 0\n1 50000.5 100000 100000\ntrue true\n",
+	},
+	{
+		name: "TDigest Merge()",
+		args: []string{
+			`-b`, `a, b := NewTDigest(), NewTDigest()`,
+			`-b`, `for i := 1; i <= 1000; i++ { if i%2 == 0 { a.Add(float64(i)) } else { b.Add(float64(i)) } }`,
+			`-b`, `a.Merge(b); a.Merge(NewTDigest()); Println(a.Count(), a.Quantile(0), a.Quantile(0.5), a.Quantile(1))`,
+		},
+		out: "1000 1 500.5 1000\n",
+	},
+	{
+		name: "TDigest invalid quantile",
+		args: []string{`-b`, `var d TDigest; d.Add(1); Println(d.Quantile(50))`},
+		err:  "Quantile q must be between 0 and 1, not 50\n",
+	},
+	{
+		name: "TDigest NaN quantile",
+		args: []string{`-b`, `var d TDigest; d.Add(1); Println(d.Quantile(math.NaN()))`},
+		err:  "Quantile q must be between 0 and 1, not NaN\n",
+	},
+	{
+		name: "DistinctCounter",
+		args: []string{
+			`-b`, `var c DistinctCounter; Println(c.Estimate())`,
+			`-b`, `for i := 0; i < 3000; i++ { c.Add(strconv.Itoa(i % 1000)) }; Println(c.Estimate())`,
+			`-b`, `for i := 0; i < 100000; i++ { c.Add(strconv.Itoa(i)) }`,
+			`-b`, `Println(math.Abs(float64(c.Estimate())-100000) < 2000)`,
+		},
+		out: "0\n1003\ntrue\n",
+	},
+	{
+		name: "DistinctCounter Merge()",
+		args: []string{
+			`-b`, `a, b := NewDistinctCounter(), NewDistinctCounter()`,
+			`-b`, `for i := 0; i < 600; i++ { a.Add(strconv.Itoa(i)); b.Add(strconv.Itoa(i+400)) }`,
+			`-b`, `var all DistinctCounter; for i := 0; i < 1000; i++ { all.Add(strconv.Itoa(i)) }`,
+			`-b`, `a.Merge(b); Println(a.Estimate(), a.Estimate() == all.Estimate())`,
+		},
+		out: "1003 true\n",
+	},
+	{
+		name: "Quantiles() and Estimates() with SortMap()",
+		args: []string{
+			`-b`, `digests := map[string]*TDigest{}; users := map[string]*DistinctCounter{}`,
+			`if digests[S(1)] == nil { digests[S(1)] = NewTDigest(); users[S(1)] = NewDistinctCounter() }`,
+			`digests[S(1)].Add(F(3)); users[S(1)].Add(S(2))`,
+			`-e`, `Println(SortMap(Quantiles(digests, 0.5)))`,
+			`-e`, `Println(SortMap(Estimates(users), ByValue, Reverse))`,
+		},
+		in:  "GET bob 10\nGET ann 20\nPUT bob 5\nGET bob 30\n",
+		out: "[{GET 20} {PUT 5}]\n[{GET 2} {PUT 1}]\n",
+	},
+	{
+		name: "Group Report()",
+		args: []string{
+			`-b`, `g := NewGroup("method", "status")`,
+			`g.Key(S(1), I(2)).Add("bytes", F(3)).Add("secs", F(4))`,
+			`-e`, `g.Report()`,
+			`-e`, `g.Report(ByValue, Reverse)`,
+		},
+		in: "GET 200 10 0.5\nGET 200 30 0.1\nPOST 500 5 2\nGET 404 1 0.25\n",
+		out: `
+method  status  count  bytes_sum  bytes_min  bytes_max  bytes_mean  secs_sum  secs_min  secs_max  secs_mean
+GET     200     2      40         10         30         20          0.6       0.1       0.5       0.3
+GET     404     1      1          1          1          1           0.25      0.25      0.25      0.25
+POST    500     1      5          5          5          5           2         2         2         2
+method  status  count  bytes_sum  bytes_min  bytes_max  bytes_mean  secs_sum  secs_min  secs_max  secs_mean
+GET     200     2      40         10         30         20          0.6       0.1       0.5       0.3
+POST    500     1      5          5          5          5           2         2         2         2
+GET     404     1      1          1          1          1           0.25      0.25      0.25      0.25
+`[1:],
+	},
+	{
+		name: "Group Rows() and missing metrics",
+		args: []string{
+			`-b`, `g := NewGroup()`,
+			`row := g.Key(S(1)); if NF() > 1 { row.Add("n", F(2)) }`,
+			`-e`, `for _, row := range g.Rows() { Println(row.Keys, row.Count, row.Stat("n").Sum, row.Stat("n").Mean()) }`,
+			`-e`, `g.Report()`,
+		},
+		in: "b 1\na\nb 2\n",
+		out: `
+[a] 1 0 NaN
+[b] 2 3 1.5
+key1  count  n_sum  n_min  n_max  n_mean
+a     1      -      -      -      -
+b     2      3      1      2      1.5
+`[1:],
+	},
+	{
+		name: "Group Rows() sorts keys by value",
+		args: []string{
+			`-b`, `g := NewGroup("a", "b")`,
+			`g.Key(I(1), I(2))`,
+			`-e`, `for _, row := range g.Rows() { Println(row.Keys) }`,
+			`-e`, `for _, row := range g.Rows(Reverse) { Print(row.Keys, " ") }; Println()`,
+		},
+		in:  "10 1\n9 20\n9 3\n10 0\n",
+		out: "[9 3]\n[9 20]\n[10 0]\n[10 1]\n[10 1] [10 0] [9 20] [9 3] \n",
+	},
+	{
+		name: "Group Key() mixed types",
+		args: []string{
+			`-b`, `g := NewGroup()`,
+			`-b`, `g.Key(1); g.Key("1"); g.Key("1"); g.Key(1.0); g.Key("a\x00", "b"); g.Key("a", "\x00b")`,
+			`-b`, `for _, row := range g.Rows() { Printf("%#v %d\n", row.Keys, row.Count) }`,
+		},
+		out: "[]interface {}{1} 1\n[]interface {}{1} 1\n[]interface {}{\"1\"} 2\n" +
+			"[]interface {}{\"a\", \"\\x00b\"} 1\n[]interface {}{\"a\\x00\", \"b\"} 1\n",
+	},
+	{
+		name: "Group Key() wrong number of keys",
+		args: []string{`-b`, `g := NewGroup("a", "b"); g.Key("x")`},
+		err:  "Group Key requires 2 values, not 1\n",
+	},
+	{
+		name: "Sort() Natural and Numeric",
+		args: []string{
+			`-b`, `s := []string{"file10", "file2", "file02", "a", "file1x", "File3"}`,
+			`-b`, `Println(Sort(s, Natural)); Println(Sort(s, Natural, Reverse))`,
+			`-b`, `s = []string{"10", "9", "x", "-1.5", "1e2", " 3 ", "1.0", "1"}`,
+			`-b`, `Println(Sort(s, Numeric)); Println(Sort(s, Reverse, Numeric))`,
+			`-b`, `Println(Sort([]int{3, 1, 2}, Natural))`,
+		},
+		out: `
+[File3 a file1x file02 file2 file10]
+[file10 file2 file02 file1x a File3]
+[-1.5 1 1.0  3  9 10 1e2 x]
+[x 1e2 10 9  3  1.0 1 -1.5]
+[1 2 3]
+`[1:],
+	},
+	{
+		name: "SortMap() Natural and Numeric",
+		args: []string{
+			`-b`, `m := map[string]string{"f10": "10", "f9": "9", "f100": "-1"}`,
+			`-b`, `Println(SortMap(m), SortMap(m, Natural))`,
+			`-b`, `Println(SortMap(m, ByValue), SortMap(m, ByValue, Numeric))`,
+		},
+		out: `
+[{f10 10} {f100 -1} {f9 9}] [{f9 9} {f10 10} {f100 -1}]
+[{f100 -1} {f10 10} {f9 9}] [{f100 -1} {f9 9} {f10 10}]
+`[1:],
+	},
+	{
+		name: "Sort() Natural and Numeric together",
+		args: []string{`-b`, `Println(Sort([]string{"a"}, Numeric, Natural))`},
+		err:  "Sort options Natural and Numeric not valid together\n",
+	},
 	{
 		name: "default field separator",
 		args: []string{`Printf("%v,%v,%v\n", S(1), S(2), S(3))`},
@@ -296,86 +823,773 @@ b 1
 		err:  "invalid field separator: error parsing regexp: missing closing ]: `[.,`\n",
 	},
 	{
-		name: "version -V",
-		args: []string{`-V`},
-		out:  version + "\n",
+		name: "fixed-width ranges",
+		args: []string{`-W`, `1-8,9-20,21-`, `Printf("%d %q %q %q\n", NF(), S(1), S(2), S(3))`},
+		in:   "ab      cdefghijkl  rest of it\nshort\n\n",
+		out:  "3 \"ab      \" \"cdefghijkl  \" \"rest of it\"\n3 \"short\" \"\" \"\"\n3 \"\" \"\" \"\"\n",
 	},
 	{
-		name: "version --version",
-		args: []string{`--version`},
-		out:  version + "\n",
+		name: "fixed-width widths",
+		args: []string{`-trim`, `-W8,12,*`, `Printf("%q %d %q\n", S(1), I(2), S(3))`},
+		in:   "ab      42          rest of it\n",
+		out:  "\"ab\" 42 \"rest of it\"\n",
 	},
 	{
-		name: "auto-import",
-		args: []string{`-b`, `Printf("%.2f", math.Pi)`},
-		out:  "3.14",
+		name: "fixed-width overlapping ranges",
+		args: []string{`-W`, `1-4,3-4,4-4`, `Println(S(1), S(2), S(3), S(4) == "")`},
+		in:   "abcdef\n",
+		out:  "abcd cd d true\n",
 	},
 	{
-		name: "import flag - text",
-		args: []string{
-			`-i`, `text/template`,
-			`-b`, `t := template.Must(template.New("").Parse("{{.}}"))`,
-			`-b`, `err := t.Execute(os.Stdout, "<b>foo</b>"); if err != nil { panic(err) }`,
-		},
-		out: "<b>foo</b>",
+		name: "fixed-width multi-byte characters",
+		args: []string{`-W`, `2,2,*`, `Printf("%q %q %q\n", S(1), S(2), S(3))`},
+		in:   "aé b\n€xyz\n",
+		out:  "\"a\" \"é \" \"b\"\n\"\" \"€x\" \"yz\"\n",
 	},
 	{
-		name: "import flag - html",
-		args: []string{
-			`-i`, `html/template`,
-			`-b`, `t := template.Must(template.New("").Parse("{{.}}"))`,
-			`-b`, `err := t.Execute(os.Stdout, "<b>foo</b>"); if err != nil { panic(err) }`,
-		},
-		out: "&lt;b&gt;foo&lt;/b&gt;",
+		name: "fixed-width underline",
+		args: []string{`-W`, `underline`, `-trim`, `Printf("%d %q %d %q\n", NR(), S(1), Bytes(2), S(3))`},
+		in:   "Report\nNAME   SIZE  DESC\n-----  ----  ----\nfoo    1.5K  hello world\nbarbaz 20    x\n",
+		out:  "1 \"foo\" 1536 \"hello world\"\n2 \"barbaz\" 20 \"x\"\n",
 	},
-}
-
-func TestPrig(t *testing.T) {
-	runTests(t, prigTests)
-}
-
-func runTests(t *testing.T, tests []test) {
-	t.Helper()
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			in := strings.NewReader(test.in)
-			args := []string{}
-			if *goExe != "" {
-				args = append(args, "-g", *goExe)
-			}
-			args = append(args, test.args...)
-			cmd := exec.Command("./prig", args...)
-			cmd.Stdin = in
-			outputBytes, err := cmd.CombinedOutput()
-			output := string(outputBytes)
-			if err != nil {
-				if test.err == "" {
-					t.Fatalf("expected success, got error:\n%s", output)
-				}
-				if output != test.err {
-					t.Fatalf("expected first error, got second:\n%s\n-----\n%s", test.err, output)
-				}
-				return
-			}
-			if test.err != "" {
-				t.Fatalf("got success, expected error:\n%s", test.err)
-			}
-			if output != test.out {
-				t.Fatalf("expected first output, got second:\n%s\n-----\n%s", test.out, output)
-			}
-		})
-	}
-}
-
-func TestExamples(t *testing.T) {
-	tests := []test{
-		{
-			name: "HelloWorld",
-			args: exampleToArgs(t, exampleHelloWorld),
-			out:  "Hello, world! 3.141592653589793\n",
-		},
-		{
-			name: "Average",
+	{
+		name: "fixed-width no underline",
+		args: []string{`-W`, `underline`, `Println()`},
+		in:   "NAME SIZE\nfoo 1\n",
+		err:  "no underline row found for -W underline\n",
+	},
+	{
+		name: "fixed-width invalid range",
+		args: []string{`-W`, `1-8,x`, `Println()`},
+		err:  "invalid -W column spec \"1-8,x\": \"x\" is not a range\n",
+	},
+	{
+		name: "fixed-width invalid end",
+		args: []string{`-W`, `5-3`, `Println()`},
+		err:  "invalid -W column spec \"5-3\": invalid end column \"3\"\n",
+	},
+	{
+		name: "fixed-width invalid width",
+		args: []string{`-W`, `8,*,3`, `Println()`},
+		err:  "invalid -W column spec \"8,*,3\": * must be the last width\n",
+	},
+	{
+		name: "fixed-width empty spec",
+		args: []string{`-W`, ``, `Println()`},
+		err:  "invalid -W column spec \"\": no columns given\n",
+	},
+	{
+		name: "-trim without -W",
+		args: []string{`-trim`, `Println()`},
+		err:  "-trim requires -W\n",
+	},
+	{
+		name: "logfmt",
+		args: []string{`-logfmt`, `Printf("%d %q %q %q\n", NF(), S(1), S(2), S(6))`},
+		in:   "level=info msg=\"started \\\"x\\\" ok\" dur=12ms n=3 flag ts=1.5 =bad\n\nmsg=\"unterminated here\n",
+		out:  "6 \"info\" \"started \\\"x\\\" ok\" \"1.5\"\n0 \"\" \"\" \"\"\n1 \"unterminated here\" \"\" \"\"\n",
+	},
+	{
+		name: "KVS(), KVI(), KVF(), and Keys()",
+		args: []string{`Printf("%q %d %v %q %q %q\n", KVS("msg"), KVI("n"), KVF("ts"), KVS("flag"), KVS("none"), Keys())`},
+		in:   "level=info msg=\"a b\" n=3 flag ts=1.5 n=4\nplain text\n",
+		out:  "\"a b\" 3 1.5 \"\" \"\" [\"level\" \"msg\" \"n\" \"flag\" \"ts\" \"n\"]\n\"\" 0 0 \"\" \"\" [\"plain\" \"text\"]\n",
+	},
+	{
+		name: "KVI() strict",
+		args: []string{`-strict`, `KVI("n")`},
+		in:   "n=1\nn=x\n",
+		err:  "NR 2, key \"n\": invalid integer \"x\"\n",
+	},
+	{
+		name: "Logfmt() and PrintLogfmt()",
+		args: []string{`-b`, `PrintLogfmt("a", 1, "b", "two words", "c", "", "d", "q\"", "e", "é", "f", 1.5)`, `-b`, `Println(Logfmt())`},
+		out:  "a=1 b=\"two words\" c= d=\"q\\\"\" e=é f=1.5\n\n",
+	},
+	{
+		name: "Logfmt() odd arguments",
+		args: []string{`-b`, `Logfmt("a", 1, "b")`},
+		err:  "Logfmt requires key-value pairs, got 3 arguments\n",
+	},
+	{
+		name: "-logfmt with -F",
+		args: []string{`-logfmt`, `-F`, `,`, `Println()`},
+		err:  "-logfmt can't be used with -F or -W\n",
+	},
+	{
+		name: "-format combined",
+		args: []string{`-format`, `combined`, `Printf("%d %d %s %s %s %d %d %q %s\n", NR(), NF(), S(1), KVS("method"), KVS("path"), KVI("status"), KVI("bytes"), KVS("ua"), KVT("time").Format(time.RFC3339))`},
+		in: `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://example.com/" "Mozilla/4.08 [en] (Win98; I ;Nav)"` + "\n" +
+			"garbage line\n" +
+			`10.0.0.2 - - [10/Oct/2000:13:56:00 +0000] "-" 400 - "-" "-"` + "\n" +
+			`10.0.0.3 - - [10/Oct/2000:13:57:00 +0000] "GET /x HTTP/1.1" 200 5` + "\n",
+		out: "1 11 127.0.0.1 GET /apache_pb.gif 200 2326 \"Mozilla/4.08 [en] (Win98; I ;Nav)\" 2000-10-10T13:55:36-07:00\n" +
+			"3 11 10.0.0.2   400 0 \"-\" 2000-10-10T13:56:00Z\n" +
+			"format: skipped 2 of 4 records not in combined format (first NR 2)\n",
+	},
+	{
+		name: "-format common",
+		args: []string{`-format`, `common`, `Println(NF(), KVS("user"), KVS("proto"), S(9), Keys())`},
+		in:   `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326` + "\n",
+		out:  "9 frank HTTP/1.0 2326 [ip ident user time method path proto status bytes]\n",
+	},
+	{
+		name: "-format syslog",
+		args: []string{`-tz`, `UTC`, `-format`, `syslog`, `Printf("%s %q %s|%s %s\n", KVS("program"), KVS("pid"), KVS("message"), KVS("host"), KVT("time").Format("Jan 2 15:04"))`},
+		in:   "Mar  4 05:06:07 myhost sshd[123]: Accepted key for x\nMar 14 05:06:07 h cron: hi\n",
+		out:  "sshd \"123\" Accepted key for x|myhost Mar 4 05:06\ncron \"\" hi|h Mar 14 05:06\n",
+	},
+	{
+		name: "-format strict time",
+		args: []string{`-strict`, `-format`, `common`, `KVT("time")`},
+		in:   `1.2.3.4 - - [99/Oct/2000:13:55:36 -0700] "GET / HTTP/1.0" 200 1` + "\n",
+		err:  "NR 1, key \"time\": invalid time \"99/Oct/2000:13:55:36 -0700\"\n",
+	},
+	{
+		name: "-format invalid",
+		args: []string{`-format`, `json`, `Println()`},
+		err:  "invalid format \"json\" (must be combined, common, or syslog)\n",
+	},
+	{
+		name: "-format with -F",
+		args: []string{`-F`, `,`, `-format`, `common`, `Println()`},
+		err:  "-format can't be used with -F, -W, or -logfmt\n",
+	},
+	{
+		name: "-json-array",
+		args: []string{`-json-array`, `Println(NR(), S(0), PathS(""), PathI("1"))`, `-e`, `Println(NR())`},
+		in:   "[1,\n [2, 3],\n \"x y\", null, {\"a\": [4]}]\n",
+		out:  "1 1 1 0\n2 [2,3] [2,3] 3\n3 \"x y\" x y 0\n4 null  0\n5 {\"a\":[4]} {\"a\":[4]} 0\n5\n",
+	},
+	{
+		name: "-json-array empty",
+		args: []string{`-json-array`, `Println(S(0))`, `-e`, `Println(NR())`},
+		in:   " [ ] ",
+		out:  "0\n",
+	},
+	{
+		name: "-jpath",
+		args: []string{`-json-array`, `-jpath`, `data.items`, `Printf("%s|%s|%d|%v|%s|%s|%s|%v\n", S(0), PathS("user.name"), PathI("id"), PathF("f"), PathS("tags"), PathS("tags[-1]"), PathS("ok"), Path("none") == nil)`},
+		in:   `{"meta": {"n": [1, 2]}, "data": {"items": [{"id": 1, "user": {"name": "bob smith"}, "tags": ["a","b"], "ok": true}, {"id": 22, "f": 1.5, "n": 12345678901234567890}]}}`,
+		out: "{\"id\":1,\"user\":{\"name\":\"bob smith\"},\"tags\":[\"a\",\"b\"],\"ok\":true}|bob smith|1|0|[\"a\",\"b\"]|b|true|true\n" +
+			"{\"id\":22,\"f\":1.5,\"n\":12345678901234567890}||22|1.5||||true\n",
+	},
+	{
+		name: "-jpath array index",
+		args: []string{`-json-array`, `-jpath`, `a[1].b`, `Println(PathI(""))`},
+		in:   `{"a": [{"b": [5]}, {"b": [6, 7]}]}`,
+		out:  "6\n7\n",
+	},
+	{
+		name: "-jpath negative index",
+		args: []string{`-json-array`, `-json-path`, `a[-1]`, `Println()`},
+		in:   `{"a": [[1], [2]]}`,
+		err:  "index -1 in -jpath \"a[-1]\" must not be negative\n",
+	},
+	{
+		name: "-jpath not found",
+		args: []string{`-json-array`, `-jpath`, `a.c`, `Println()`},
+		in:   `{"a": {"b": []}}`,
+		err:  "path \"a.c\" not found in JSON input\n",
+	},
+	{
+		name: "-jpath not array",
+		args: []string{`-json-array`, `-jpath`, `a`, `Println()`},
+		in:   `{"a": {"b": []}}`,
+		err:  "JSON input at path \"a\" is not an array\n",
+	},
+	{
+		name: "-json-array not array",
+		args: []string{`-json-array`, `Println()`},
+		in:   `{"a": 1}`,
+		err:  "JSON input is not an array\n",
+	},
+	{
+		name: "-json-array invalid",
+		args: []string{`-json-array`, `-u`, `Println(S(0))`},
+		in:   `[1, 2 3]`,
+		err:  "1\n2\nerror reading JSON: invalid syntax after NR 2\n",
+	},
+	{
+		name: "-jpath invalid",
+		args: []string{`-json-array`, `-jpath`, `a`, `Println(S(0))`},
+		in:   `{"a" 1}`,
+		err:  "error reading JSON: invalid syntax\n",
+	},
+	{
+		name: "-json-array trailing data",
+		args: []string{`-json-array`, `-u`, `Println(S(0))`},
+		in:   "[1, 2]\n[3]\n",
+		err:  "1\n2\nerror reading JSON: unexpected data after array\n",
+	},
+	{
+		name: "-jpath trailing data",
+		args: []string{`-json-array`, `-u`, `-json-path`, `a`, `Println(S(0))`},
+		in:   `{"a": [1], "b": [{}, 2]} {}`,
+		err:  "1\nerror reading JSON: unexpected data after array\n",
+	},
+	{
+		name: "-jpath rest of input",
+		args: []string{`-json-array`, `-jpath`, `a.b`, `Println(S(0))`, `-e`, `Println(NR())`},
+		in:   `{"a": {"b": [1], "c": [2, {"d": 3}]}, "e": "f"}` + "\n",
+		out:  "1\n1\n",
+	},
+	{
+		name: "-jpath without -json-array",
+		args: []string{`-json-path`, `a`, `Println()`},
+		err:  "-jpath requires -json-array\n",
+	},
+	{
+		name: "Path() on JSON lines",
+		args: []string{`-warn`, `Println(PathS("a.b"), PathI("a.b") * 2, PathS("a"))`},
+		in:   "{\"a\": {\"b\": 2}}\nnot json\n{\"a\": \"x\"}\n",
+		out:  "2 4 {\"b\":2}\n 0 \n 0 x\nwarning: 3 conversion errors, first at NR 2: invalid JSON \"not json\"\n",
+	},
+	{
+		name: "Prometheus metrics",
+		args: []string{
+			`-prom`, `-`,
+			`PromCounter("http_requests_total", "Total requests.\nBy \\ method", "method", S(1), "code", S(2)).Inc()`,
+			`PromHistogram("latency_seconds", "", []float64{1, 0.1}, "method", S(1)).Observe(F(3))`,
+			`-e`, `PromGauge("info", "Info", "path", "a\"b\\c\nd").Set(math.Inf(1)); PromGauge("up", "Up.").Add(2.5); Println("end")`,
+		},
+		in: "GET 200 0.02\nPOST 500 0.3\nGET 200 1.5\nGET 404 20\n",
+		out: "end\n" +
+			"# HELP http_requests_total Total requests.\\nBy \\\\ method\n" +
+			"# TYPE http_requests_total counter\n" +
+			"http_requests_total{code=\"200\",method=\"GET\"} 2\n" +
+			"http_requests_total{code=\"404\",method=\"GET\"} 1\n" +
+			"http_requests_total{code=\"500\",method=\"POST\"} 1\n" +
+			"# HELP info Info\n" +
+			"# TYPE info gauge\n" +
+			"info{path=\"a\\\"b\\\\c\\nd\"} +Inf\n" +
+			"# TYPE latency_seconds histogram\n" +
+			"latency_seconds_bucket{method=\"GET\",le=\"0.1\"} 1\n" +
+			"latency_seconds_bucket{method=\"GET\",le=\"1\"} 1\n" +
+			"latency_seconds_bucket{method=\"GET\",le=\"+Inf\"} 3\n" +
+			"latency_seconds_sum{method=\"GET\"} 21.52\n" +
+			"latency_seconds_count{method=\"GET\"} 3\n" +
+			"latency_seconds_bucket{method=\"POST\",le=\"0.1\"} 0\n" +
+			"latency_seconds_bucket{method=\"POST\",le=\"1\"} 1\n" +
+			"latency_seconds_bucket{method=\"POST\",le=\"+Inf\"} 1\n" +
+			"latency_seconds_sum{method=\"POST\"} 0.3\n" +
+			"latency_seconds_count{method=\"POST\"} 1\n" +
+			"# HELP up Up.\n" +
+			"# TYPE up gauge\n" +
+			"up 2.5\n",
+	},
+	{
+		name: "Prometheus default buckets",
+		args: []string{`-prom`, `-`, `-b`, `PromHistogram("h", "", nil).Observe(0.5)`},
+		out: "# TYPE h histogram\n" +
+			"h_bucket{le=\"0.005\"} 0\nh_bucket{le=\"0.01\"} 0\nh_bucket{le=\"0.025\"} 0\nh_bucket{le=\"0.05\"} 0\n" +
+			"h_bucket{le=\"0.1\"} 0\nh_bucket{le=\"0.25\"} 0\nh_bucket{le=\"0.5\"} 1\nh_bucket{le=\"1\"} 1\n" +
+			"h_bucket{le=\"2.5\"} 1\nh_bucket{le=\"5\"} 1\nh_bucket{le=\"10\"} 1\nh_bucket{le=\"+Inf\"} 1\n" +
+			"h_sum 0.5\nh_count 1\n",
+	},
+	{
+		name: "Prometheus duplicate and unsorted buckets",
+		args: []string{`-prom`, `-`, `-b`, `PromHistogram("h", "", []float64{2, 1, 2, math.Inf(1)}).Observe(1.5)`},
+		out: "# TYPE h histogram\n" +
+			"h_bucket{le=\"1\"} 0\nh_bucket{le=\"2\"} 1\nh_bucket{le=\"+Inf\"} 1\n" +
+			"h_sum 1.5\nh_count 1\n",
+	},
+	{
+		name: "Prometheus NaN bucket",
+		args: []string{`-b`, `PromHistogram("h", "", []float64{1, math.NaN()})`},
+		err:  "Prometheus histogram \"h\" bucket must not be NaN\n",
+	},
+	{
+		name: "Prometheus same buckets",
+		args: []string{`-prom`, `-`, `-b`, `PromHistogram("h", "", []float64{1, 2}).Observe(1.5); PromHistogram("h", "", []float64{2, 1, 2}, "a", "b").Observe(0.5)`},
+		out: "# TYPE h histogram\n" +
+			"h_bucket{le=\"1\"} 0\nh_bucket{le=\"2\"} 1\nh_bucket{le=\"+Inf\"} 1\n" +
+			"h_sum 1.5\nh_count 1\n" +
+			"h_bucket{a=\"b\",le=\"1\"} 1\nh_bucket{a=\"b\",le=\"2\"} 1\nh_bucket{a=\"b\",le=\"+Inf\"} 1\n" +
+			"h_sum{a=\"b\"} 0.5\nh_count{a=\"b\"} 1\n",
+	},
+	{
+		name: "Prometheus different buckets",
+		args: []string{`-b`, `PromHistogram("h", "", nil); PromHistogram("h", "", []float64{1})`},
+		err:  "Prometheus histogram \"h\" buckets differ from earlier call\n",
+	},
+	{
+		name: "Prometheus duplicate label",
+		args: []string{`-b`, `PromGauge("x", "", "a", "1", "b", "2", "a", "3")`},
+		err:  "duplicate Prometheus label name \"a\" for metric \"x\"\n",
+	},
+	{
+		name: "Prometheus kind mismatch",
+		args: []string{`-b`, `PromCounter("x", ""); PromGauge("x", "")`},
+		err:  "Prometheus metric \"x\" is a counter, not a gauge\n",
+	},
+	{
+		name: "Prometheus Set counter",
+		args: []string{`-b`, `PromCounter("x", "").Set(1)`},
+		err:  "can't Set Prometheus counter \"x\"\n",
+	},
+	{
+		name: "Prometheus negative counter",
+		args: []string{`-b`, `PromCounter("x", "").Add(-1)`},
+		err:  "can't Add negative value to Prometheus counter \"x\"\n",
+	},
+	{
+		name: "Prometheus invalid name",
+		args: []string{`-b`, `PromGauge("x-y", "")`},
+		err:  "invalid Prometheus metric name \"x-y\"\n",
+	},
+	{
+		name: "Prometheus invalid labels",
+		args: []string{`-b`, `PromGauge("x", "", "a")`},
+		err:  "Prometheus metric \"x\" labels must be name-value pairs\n",
+	},
+	{
+		name: "Histogram()",
+		args: []string{`-b`, `os.Setenv("COLUMNS", "40")`, `Printf("%.1f\n", F(1))`, `v = append(v, F(1))`, `-b`, `var v []float64`, `-e`, `Histogram(v, 3); Histogram(v, 3, LogScale); Histogram([]int{5, 5}, 4); Histogram([]int{}, 4)`},
+		in:   "1\n2\n2\n3\n3\n3\n4\n10\n",
+		out: "1.0\n2.0\n2.0\n3.0\n3.0\n3.0\n4.0\n10.0\n" +
+			"[1, 4)   6  ████████████████████████████\n" +
+			"[4, 7)   1  ████▋\n" +
+			"[7, 10]  1  ████▋\n" +
+			"[1, 4)   6  ████████████████████████████\n" +
+			"[4, 7)   1  ██████████\n" +
+			"[7, 10]  1  ██████████\n" +
+			"[5, 5]  2  █████████████████████████████\n",
+	},
+	{
+		name: "HistogramEdges()",
+		args: []string{`-b`, `HistogramEdges([]float64{1, 2, 2, 3, 3, 3, 4, 10, 0.1234567}, []float64{2, 3, 5})`},
+		out: "< 2     2  ██████████████████████████████████▌\n" +
+			"[2, 3)  2  ██████████████████████████████████▌\n" +
+			"[3, 5]  4  █████████████████████████████████████████████████████████████████████\n" +
+			"> 5     1  █████████████████▎\n",
+	},
+	{
+		name: "HistogramEdges() invalid edges",
+		args: []string{`-b`, `HistogramEdges([]int{1}, []float64{2, 1})`},
+		err:  "HistogramEdges edges must be increasing\n",
+	},
+	{
+		name: "Histogram() NaN and Inf values",
+		args: []string{
+			`-b`, `os.Setenv("COLUMNS", "30")`,
+			`-b`, `Histogram([]float64{1, 2, math.NaN()}, 2); Histogram([]float64{math.Inf(-1), 1, 3, math.Inf(1), math.NaN()}, 2)`,
+			`-b`, `HistogramEdges([]float64{1, math.NaN()}, []float64{0, 5}); Histogram([]float64{math.NaN()}, 2)`,
+		},
+		out: "[1, 1.5)  1  " + strings.Repeat("█", 17) + "\n" +
+			"[1.5, 2]  1  " + strings.Repeat("█", 17) + "\n" +
+			"NaN       1  " + strings.Repeat("█", 17) + "\n" +
+			"< 1     1  " + strings.Repeat("█", 19) + "\n" +
+			"[1, 2)  1  " + strings.Repeat("█", 19) + "\n" +
+			"[2, 3]  1  " + strings.Repeat("█", 19) + "\n" +
+			"> 3     1  " + strings.Repeat("█", 19) + "\n" +
+			"NaN     1  " + strings.Repeat("█", 19) + "\n" +
+			"[0, 5]  1  " + strings.Repeat("█", 19) + "\n" +
+			"NaN     1  " + strings.Repeat("█", 19) + "\n",
+	},
+	{
+		name: "HistogramEdges() non-finite edges",
+		args: []string{`-b`, `HistogramEdges([]int{1}, []float64{1, math.Inf(1)})`},
+		err:  "HistogramEdges edges must be finite\n",
+	},
+	{
+		name: "Histogram() edge labels",
+		args: []string{`-b`, `os.Setenv("COLUMNS", "0")`, `-b`, `Histogram([]float64{0.1234567, 1234567, -2}, 2)`},
+		out: "[-2, 617300)       2  " + strings.Repeat("█", 58) + "\n" +
+			"[617300, 1235000]  1  " + strings.Repeat("█", 29) + "\n",
+	},
+	{
+		name: "BarChart()",
+		args: []string{`-b`, `os.Setenv("COLUMNS", "30")`, `c[S(1)] += I(2)`, `-b`, `c := map[string]int{}`, `-e`, `BarChart(SortMap(c, ByValue, Reverse)); BarChart(SortMap(c), LogScale)`},
+		in:   "apple 4\nkiwi 3\napple 6\nbanana 1\nfig 0\n",
+		out: "apple   10  ██████████████████\n" +
+			"kiwi     3  █████▍\n" +
+			"banana   1  █▊\n" +
+			"fig      0\n" +
+			"apple   10  ██████████████████\n" +
+			"banana   1  █████▎\n" +
+			"fig      0\n" +
+			"kiwi     3  ██████████▍\n",
+	},
+	{
+		name: "BarChart() invalid values",
+		args: []string{`-b`, `BarChart(SortMap(map[string]string{"a": "b"}))`},
+		err:  "BarChart values must be int or float64\n",
+	},
+	{
+		name: "Sparkline()",
+		args: []string{`-b`, `Println(Sparkline([]float64{1, 2, 3, 4, 5, 6, 7, 8, math.NaN(), 1}) + "|" + Sparkline([]float64{3, 3}) + "|" + Sparkline(nil) + "|")`},
+		out:  "▁▂▃▄▅▆▇█ ▁|▅▅||\n",
+	},
+	{
+		name: "Sparkline() and BarChart() infinite values",
+		args: []string{
+			`-b`, `os.Setenv("COLUMNS", "20")`,
+			`-b`, `Println(Sparkline([]float64{1, math.Inf(1), 3, math.Inf(-1), 2}), Sparkline([]float64{-1e308, 1e308}))`,
+			`-b`, `BarChart(SortMap(map[string]float64{"a": math.NaN(), "b": 2, "c": math.Inf(1), "d": 1}))`,
+		},
+		out: "▁██▁▅ ▁█\n" +
+			"a   NaN\n" +
+			"b     2  " + strings.Repeat("█", 11) + "\n" +
+			"c  +Inf  " + strings.Repeat("█", 11) + "\n" +
+			"d     1  █████▌\n",
+	},
+	{
+		name: "version -V",
+		args: []string{`-V`},
+		out:  version + "\n",
+	},
+	{
+		name: "version --version",
+		args: []string{`--version`},
+		out:  version + "\n",
+	},
+	{
+		name: "auto-import",
+		args: []string{`-b`, `Printf("%.2f", math.Pi)`},
+		out:  "3.14",
+	},
+	{
+		name: "import flag - text",
+		args: []string{
+			`-i`, `text/template`,
+			`-b`, `t := template.Must(template.New("").Parse("{{.}}"))`,
+			`-b`, `err := t.Execute(os.Stdout, "<b>foo</b>"); if err != nil { panic(err) }`,
+		},
+		out: "<b>foo</b>",
+	},
+	{
+		name: "import flag - html",
+		args: []string{
+			`-i`, `html/template`,
+			`-b`, `t := template.Must(template.New("").Parse("{{.}}"))`,
+			`-b`, `err := t.Execute(os.Stdout, "<b>foo</b>"); if err != nil { panic(err) }`,
+		},
+		out: "&lt;b&gt;foo&lt;/b&gt;",
+	},
+}
+
+// Tests for builtins whose usage differs with and without generics.
+var genericTests = []test{
+	{
+		name: "BarChart() int keys",
+		args: []string{`-b`, `os.Setenv("COLUMNS", "20")`, `-b`, `BarChart(SortPairs(map[int]float64{404: 2.5, 200: 10}))`},
+		out:  "200   10  ██████████\n404  2.5  ██▌\n",
+	},
+	{
+		name: "Counter",
+		args: []string{
+			`-b`, `var c Counter[string]`,
+			`for i := 1; i <= NF(); i++ { c.Inc(strings.ToLower(S(i))) }`,
+			`-e`, `c.Add("bar", 2); Println(c.Top(2), c.Bottom(2), c.Top(0))`,
+			`-e`, `Println(c.Top(10), c.Get("foo"), c.Get("x"), c.Len(), c.Total())`,
+		},
+		in:  "The foo bar foo bar\nthe the the\nend.\n",
+		out: "[{bar 4} {the 4}] [{end. 1} {foo 2}] []\n[{bar 4} {the 4} {foo 2} {end. 1}] 2 0 4 11\n",
+	},
+	{
+		name: "SortPairs() non-string keys",
+		args: []string{
+			`-b`, `Println(SortPairs(map[int]string{404: "b", 200: "c", 500: "a"}))`,
+			`-b`, `Println(SortPairs(map[int]string{404: "b", 200: "c", 500: "a"}, ByValue))`,
+			`-b`, `Println(SortPairs(map[float64]int{1.5: 2, -1: 3}, Reverse))`,
+			`-b`, `pairs := SortPairs(map[int]int{23: 5, 9: 1}); Println(pairs[0].K+1, pairs[0].V)`,
+		},
+		out: "[{200 c} {404 b} {500 a}]\n[{500 a} {404 b} {200 c}]\n[{1.5 2} {-1 3}]\n10 1\n",
+	},
+	{
+		name: "SortMap() returns KV[T]",
+		args: []string{
+			`-b`, `var kvs []KV[int] = SortMap(map[string]int{"b": 1, "a": 2}); Println(kvs)`,
+			`-b`, `f := func(kv KV[string]) string { return kv.K + kv.V }; Println(f(SortMap(map[string]string{"x": "y"})[0]))`,
+		},
+		out: "[{a 2} {b 1}]\nxy\n",
+	},
+	{
+		name: "SortPairs() named string keys",
+		args: []string{
+			`-b`, `type name string`,
+			`-b`, `Println(SortPairs(map[name]int{"file10": 1, "file2": 2, "file1": 3}, Natural))`,
+			`-b`, `var pairs []Pair[name, int] = SortPairs(map[name]int{"10": 1, "9": 2}, Numeric); Println(pairs)`,
+		},
+		out: "[{file1 3} {file2 2} {file10 1}]\n[{9 2} {10 1}]\n",
+	},
+	{
+		name: "Counter int keys",
+		args: []string{
+			`-b`, `var c Counter[int]`,
+			`c.Inc(I(1))`,
+			`-e`, `Println(c.Top(2), c.Bottom(1))`,
+		},
+		in:  "404\n200\n500\n200\n404\n200\n",
+		out: "[{200 3} {404 2}] [{500 1}]\n",
+	},
+}
+
+var nonGenericTests = []test{
+	{
+		name: "Counter",
+		args: []string{
+			`-b`, `var c Counter`,
+			`for i := 1; i <= NF(); i++ { c.Inc(strings.ToLower(S(i))) }`,
+			`-e`, `c.Add("bar", 2); Println(c.Top(2), c.Bottom(2), c.Top(0))`,
+			`-e`, `Println(c.Top(10), c.Get("foo"), c.Get("x"), c.Len(), c.Total())`,
+		},
+		in:  "The foo bar foo bar\nthe the the\nend.\n",
+		out: "[{bar 4} {the 4}] [{end. 1} {foo 2}] []\n[{bar 4} {the 4} {foo 2} {end. 1}] 2 0 4 11\n",
+	},
+	{
+		name: "Counter int keys",
+		args: []string{
+			`-b`, `var c Counter`,
+			`c.Inc(I(1))`,
+			`-e`, `Println(c.Top(2), c.Bottom(1))`,
+		},
+		in:  "404\n200\n500\n200\n404\n200\n",
+		out: "[{200 3} {404 2}] [{500 1}]\n",
+	},
+	{
+		name: "SortPairs() non-string keys",
+		args: []string{`-b`, `Println(SortPairs(map[int]string{404: "b"}))`},
+		err:  "SortMap type must be map[string]T with T int, float64, or string\n",
+	},
+	{
+		name: "Counter invalid key",
+		args: []string{`-b`, `var c Counter; c.Inc([]int{})`},
+		err:  "Counter key type must be int, float64, or string\n",
+	},
+}
+
+func TestPrig(t *testing.T) {
+	runTests(t, prigTests)
+}
+
+func TestGenerics(t *testing.T) {
+	if usingGenerics {
+		runTests(t, genericTests)
+	} else {
+		runTests(t, nonGenericTests)
+	}
+}
+
+func runTests(t *testing.T, tests []test) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := strings.NewReader(test.in)
+			cmd := exec.Command("./prig", goExeArgs(test.args...)...)
+			cmd.Stdin = in
+			outputBytes, err := cmd.CombinedOutput()
+			output := string(outputBytes)
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("expected success, got error:\n%s", output)
+				}
+				if output != test.err {
+					t.Fatalf("expected first error, got second:\n%s\n-----\n%s", test.err, output)
+				}
+				return
+			}
+			if test.err != "" {
+				t.Fatalf("got success, expected error:\n%s", test.err)
+			}
+			if output != test.out {
+				t.Fatalf("expected first output, got second:\n%s\n-----\n%s", test.out, output)
+			}
+		})
+	}
+}
+
+func TestDevNullBuffered(t *testing.T) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	cmd := exec.Command("./prig", goExeArgs(`-b`, `fmt.Fprintln(os.Stderr, _lineBuffered)`)...)
+	cmd.Stdout = devNull
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil || stderr.String() != "false\n" {
+		t.Fatalf("expected output to %s not to be line buffered, got %q (%v)", os.DevNull, stderr.String(), err)
+	}
+}
+
+func TestFlushWhileReading(t *testing.T) {
+	for _, args := range [][]string{
+		{`-u`, `Println(S(1))`},
+		{`-flush-interval`, `10ms`, `Println(S(1))`},
+	} {
+		t.Run(args[0], func(t *testing.T) {
+			cmd, stdin, stdout := startPrig(t, args...)
+			defer cmd.Wait()
+			defer stdin.Close()
+
+			// Output should arrive while stdin is still open.
+			_, err := io.WriteString(stdin, "foo bar\n")
+			if err != nil {
+				t.Fatalf("error writing: %v", err)
+			}
+			line, err := stdout.ReadString('\n')
+			if err != nil {
+				t.Fatalf("error reading: %v", err)
+			}
+			if line != "foo\n" {
+				t.Fatalf("expected %q, got %q", "foo\n", line)
+			}
+		})
+	}
+}
+
+func TestFlushError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses read-only stdout")
+	}
+	readOnly, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("error opening %s: %v", os.DevNull, err)
+	}
+	defer readOnly.Close()
+
+	// Writes are buffered, so this error comes from the final flush.
+	cmd := exec.Command("./prig", goExeArgs(`-b`, `Print("foo")`)...)
+	cmd.Stdout = readOnly
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil {
+		t.Fatalf("expected error, got success")
+	}
+	if !strings.HasPrefix(stderr.String(), "error writing output: ") {
+		t.Fatalf("expected output error, got:\n%s", stderr.String())
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("can't send SIGINT on Windows")
+	}
+	cmd, stdin, stdout := startPrig(t,
+		`-u`, `-b`, `n := 0`, `n++; Println("got", S(0))`, `-e`, `Println("end", n)`)
+	defer stdin.Close()
+	_, err := io.WriteString(stdin, "foo\n")
+	if err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	line, err := stdout.ReadString('\n')
+	if err != nil || line != "got foo\n" {
+		t.Fatalf("expected %q, got %q (%v)", "got foo\n", line, err)
+	}
+
+	// Signal Prig itself, which forwards the signal to the program.
+	err = cmd.Process.Signal(os.Interrupt)
+	if err != nil {
+		t.Fatalf("error sending signal: %v", err)
+	}
+	rest, err := io.ReadAll(stdout)
+	if err != nil || string(rest) != "end 1\n" {
+		t.Fatalf("expected %q, got %q (%v)", "end 1\n", rest, err)
+	}
+	err = cmd.Wait()
+	if cmd.ProcessState.ExitCode() != 130 {
+		t.Fatalf("expected exit status 130, got %v", err)
+	}
+}
+
+func TestInterruptBegin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("can't send SIGINT on Windows")
+	}
+	cmd, stdin, stdout := startPrig(t,
+		`-u`, `-b`, `Println("begin"); for {}`, `-e`, `Println("end")`)
+	defer stdin.Close()
+	line, err := stdout.ReadString('\n')
+	if err != nil || line != "begin\n" {
+		t.Fatalf("expected %q, got %q (%v)", "begin\n", line, err)
+	}
+
+	// A single signal during begin code should exit without running end.
+	err = cmd.Process.Signal(os.Interrupt)
+	if err != nil {
+		t.Fatalf("error sending signal: %v", err)
+	}
+	rest, err := io.ReadAll(stdout)
+	if err != nil || string(rest) != "" {
+		t.Fatalf("expected no more output, got %q (%v)", rest, err)
+	}
+	err = cmd.Wait()
+	if cmd.ProcessState.ExitCode() != 130 {
+		t.Fatalf("expected exit status 130, got %v", err)
+	}
+}
+
+func TestBrokenPipe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGPIPE on Windows")
+	}
+	cmd := exec.Command("./prig", goExeArgs(`-b`, `for i := 0; ; i++ { Println(i) }`)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("error creating stdout pipe: %v", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("error starting prig: %v", err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "0\n" {
+		t.Fatalf("expected %q, got %q (%v)", "0\n", line, err)
+	}
+	stdout.Close()
+	err = cmd.Wait()
+	if cmd.ProcessState.ExitCode() != 141 {
+		t.Fatalf("expected exit status 141, got %v", err)
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("expected no error message, got:\n%s", stderr.String())
+	}
+}
+
+// startPrig starts Prig with the given arguments and returns the running
+// command along with pipes connected to its stdin and stdout.
+func startPrig(t *testing.T, args ...string) (*exec.Cmd, io.WriteCloser, *bufio.Reader) {
+	t.Helper()
+	cmd := exec.Command("./prig", goExeArgs(args...)...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("error creating stdin pipe: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("error creating stdout pipe: %v", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("error starting prig: %v", err)
+	}
+	return cmd, stdin, bufio.NewReader(stdout)
+}
+
+func goExeArgs(args ...string) []string {
+	if *goExe != "" {
+		args = append([]string{"-g", *goExe}, args...)
+	}
+	return args
+}
+
+func TestExamples(t *testing.T) {
+	tests := []test{
+		{
+			name: "HelloWorld",
+			args: exampleToArgs(t, exampleHelloWorld),
+			out:  "Hello, world! 3.141592653589793\n",
+		},
+		{
+			name: "Average",
 			args: exampleToArgs(t, exampleAverage),
 			in:   "a b 400\nc d 200\ne f 200\ng h 200",
 			out:  "250\n",
@@ -414,3 +1628,448 @@ func exampleToArgs(t *testing.T, s string) []string {
 	}
 	return args
 }
+
+func TestLiteralRegexes(t *testing.T) {
+	cmd := exec.Command("./prig", goExeArgs("-s", "Println(Match(`a+`, S(1)), Split(`a+`, S(2)), Replace(`b`, S(0), `c`))")...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error printing source: %v\n%s", err, output)
+	}
+	for _, want := range []string{
+		"_matchRe(_re0, S(1))",
+		"_splitRe(_re0, S(2))",
+		"_replaceRe(_re1, S(0), `c`)",
+		"var _re0 = regexp.MustCompile(`a+`)",
+		"var _re1 = regexp.MustCompile(`b`)",
+	} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("expected source to contain %q", want)
+		}
+	}
+
+	// Invalid literal regexes are reported before building.
+	cmd = exec.Command("./prig", goExeArgs("if Match(`[a`, S(0)) { Println() }")...)
+	output, err = cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected error, got success:\n%s", output)
+	}
+	lines := strings.Split(string(output), "\n")
+	if len(lines) != 4 ||
+		!regexp.MustCompile(`^main.go:\d+:\d+: invalid regex "\[a": error parsing regexp: missing closing \]`).MatchString(lines[0]) ||
+		strings.TrimSpace(lines[1]) != "if Match(`[a`, S(0)) {" ||
+		strings.Index(lines[2], "^") != strings.Index(lines[1], "`[a`") {
+		t.Fatalf("unexpected error output:\n%s", output)
+	}
+
+	// Compile errors show the user's code and columns, not the rewritten calls.
+	cmd = exec.Command("./prig", goExeArgs("if Match(`a`, S(0)) && Replace(`b`, S(1), `c`) == x { Println() }")...)
+	output, err = cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected error, got success:\n%s", output)
+	}
+	lines = strings.Split(string(output), "\n")
+	if len(lines) != 4 ||
+		!regexp.MustCompile(`^main.go:\d+:\d+: undefined: x$`).MatchString(lines[0]) ||
+		strings.TrimSpace(lines[1]) != "if Match(`a`, S(0)) && Replace(`b`, S(1), `c`) == x {" ||
+		strings.Index(lines[2], "^") != strings.LastIndex(lines[1], "x") {
+		t.Fatalf("unexpected error output:\n%s", output)
+	}
+}
+
+// buildPrigProgram builds the Go program Prig generates for args (by using
+// "prig -s" and "go build") and returns the executable's path.
+func buildPrigProgram(b *testing.B, args ...string) string {
+	source, err := exec.Command("./prig", goExeArgs(append([]string{"-s"}, args...)...)...).Output()
+	if err != nil {
+		b.Fatalf("error generating source: %v", err)
+	}
+	dir := b.TempDir()
+	goFilename := filepath.Join(dir, "main.go")
+	err = os.WriteFile(goFilename, source, 0666)
+	if err != nil {
+		b.Fatalf("error writing source: %v", err)
+	}
+	exeFilename := filepath.Join(dir, "main")
+	if runtime.GOOS == "windows" {
+		exeFilename += ".exe"
+	}
+	buildExe := *goExe
+	if buildExe == "" {
+		buildExe = "go"
+	}
+	output, err := exec.Command(buildExe, "build", "-o", exeFilename, goFilename).CombinedOutput()
+	if err != nil {
+		b.Fatalf("error building program: %v\n%s", err, output)
+	}
+	return exeFilename
+}
+
+func benchmarkRegexCache(b *testing.B, numPatterns int, args ...string) {
+	exe := buildPrigProgram(b, append(args, `Match(S(1), S(2))`)...)
+	var input strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&input, "id%d x%d\n", i%numPatterns, i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cmd := exec.Command(exe)
+		cmd.Stdin = strings.NewReader(input.String())
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			b.Fatalf("error running program: %v\n%s", err, output)
+		}
+	}
+}
+
+func BenchmarkRegexCacheHits(b *testing.B) {
+	benchmarkRegexCache(b, 50)
+}
+
+func BenchmarkRegexCacheLarge(b *testing.B) {
+	benchmarkRegexCache(b, 500, "-recache", "1000")
+}
+
+func BenchmarkRegexCacheMisses(b *testing.B) {
+	benchmarkRegexCache(b, 500)
+}
+
+func BenchmarkRegexCacheDisabled(b *testing.B) {
+	benchmarkRegexCache(b, 50, "-recache", "0")
+}
+
+func BenchmarkLiteralRegex(b *testing.B) {
+	exe := buildPrigProgram(b, "Match(`^id\\d+$`, S(1))")
+	input := strings.Repeat("id123 x\n", 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cmd := exec.Command(exe)
+		cmd.Stdin = strings.NewReader(input)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			b.Fatalf("error running program: %v\n%s", err, output)
+		}
+	}
+}
+
+func TestOutputFiles(t *testing.T) {
+	dir := t.TempDir()
+	var input strings.Builder
+	for i := 0; i < 250; i++ {
+		fmt.Fprintf(&input, "f%d %d\n", i%150, i)
+	}
+	// Writes to 150 files, so some are closed and later reopened.
+	cmd := exec.Command("./prig", goExeArgs(
+		"-b", "dir := "+strconv.Quote(dir),
+		"PrintlnTo(filepath.Join(dir, S(1)), S(2)); PrintTo(filepath.Join(dir, \"all\"), S(2), \" \")",
+		"-e", "PrintfTo(filepath.Join(dir, \"all\"), \"%d\\n\", NR()); Println(\"done\")",
+	)...)
+	cmd.Stdin = strings.NewReader(input.String())
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error running prig: %v\n%s", err, output)
+	}
+	if string(output) != "done\n" {
+		t.Fatalf("expected \"done\", got %q", output)
+	}
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"f0", "0\n150\n"},
+		{"f99", "99\n249\n"},
+		{"f100", "100\n"},
+		{"f149", "149\n"},
+	} {
+		content, err := os.ReadFile(filepath.Join(dir, test.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, content)
+		}
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "all"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(content), "0 1 2 ") || !strings.HasSuffix(string(content), " 248 249 250\n") {
+		t.Errorf("unexpected content in \"all\": %q", content)
+	}
+
+	// Writing to a file after closing it truncates it again, like AWK.
+	name := filepath.Join(dir, "closed")
+	cmd = exec.Command("./prig", goExeArgs("-b", fmt.Sprintf(
+		`PrintlnTo(%q, "a"); Close(%[1]q); PrintlnTo(%[1]q, "b"); PrintlnTo("/dev/stderr", "c")`, name))...)
+	output, err = cmd.CombinedOutput()
+	if err != nil || string(output) != "c\n" {
+		t.Fatalf("expected \"c\", got %q (%v)", output, err)
+	}
+	content, err = os.ReadFile(name)
+	if err != nil || string(content) != "b\n" {
+		t.Fatalf("expected \"b\", got %q (%v)", content, err)
+	}
+
+	// Writes to stdout go through the buffered output, in order.
+	cmd = exec.Command("./prig", goExeArgs("-b",
+		`Println("a"); PrintlnTo("/dev/stdout", "b"); Print("c "); PrintfTo("-", "%d\n", 4); Close("-"); PrintTo("-", "e\n")`)...)
+	output, err = cmd.CombinedOutput()
+	if err != nil || string(output) != "a\nb\nc 4\ne\n" {
+		t.Fatalf("expected \"a b c 4 e\", got %q (%v)", output, err)
+	}
+
+	cmd = exec.Command("./prig", goExeArgs("PrintlnTo(\"/no/such/dir/x\", S(0))")...)
+	cmd.Stdin = strings.NewReader("x\n")
+	output, err = cmd.CombinedOutput()
+	if err == nil || !strings.HasPrefix(string(output), "error opening output file: open /no/such/dir/x: ") {
+		t.Fatalf("expected error opening file, got %q (%v)", output, err)
+	}
+}
+
+func TestPipeTo(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("PipeTo tests use Unix shell commands")
+	}
+	cmd := exec.Command("./prig", goExeArgs(
+		"-b", `Println("begin")`,
+		`PipeTo("sort -n", S(1)); PipeTo("tr a-z A-Z", S(2))`,
+		"-e", `Close("sort -n"); Println("end")`,
+	)...)
+	cmd.Stdin = strings.NewReader("3 c\n1 a\n2 b\n")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error running prig: %v\n%s", err, output)
+	}
+	want := "begin\n1\n2\n3\nend\nC\nA\nB\n"
+	if string(output) != want {
+		t.Fatalf("expected %q, got %q", want, output)
+	}
+
+	// Close flushes our output before the command's remaining output.
+	cmd = exec.Command("./prig", goExeArgs("-b", `PipeTo("cat", "x"); Println("y"); Close("cat"); Println("z")`)...)
+	output, err = cmd.CombinedOutput()
+	if err != nil || string(output) != "y\nx\nz\n" {
+		t.Fatalf("expected \"y x z\", got %q (%v)", output, err)
+	}
+
+	// Pipes count toward the limit on open files, but aren't closed.
+	cmd = exec.Command("./prig", goExeArgs("-b", `for i := 0; i <= 100; i++ { PipeTo(fmt.Sprint("cat >/dev/null #", i), i) }`)...)
+	output, err = cmd.CombinedOutput()
+	if err == nil || string(output) != "too many open pipes (maximum 100)\n" {
+		t.Fatalf("expected too many pipes error, got %q (%v)", output, err)
+	}
+
+	// A command that exits early isn't an error.
+	cmd = exec.Command("./prig", goExeArgs(`PipeTo("head -n1", S(0))`)...)
+	cmd.Stdin = strings.NewReader(strings.Repeat("line\n", 100000))
+	output, err = cmd.CombinedOutput()
+	if err != nil || string(output) != "line\n" {
+		t.Fatalf("expected \"line\", got %q (%v)", output, err)
+	}
+}
+
+func TestReadFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lookup.csv")
+	err := os.WriteFile(path, []byte("1.2.3.4,au\n5.6.7.8,nz\n\n9.9.9.9 , us\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []test{
+		{
+			name: "Lines()",
+			args: []string{`-b`, fmt.Sprintf(`lines := Lines(%q); Printf("%%d %%q\n", len(lines), lines)`, path)},
+			out:  "4 [\"1.2.3.4,au\" \"5.6.7.8,nz\" \"\" \"9.9.9.9 , us\"]\n",
+		},
+		{
+			name: "ReadFields()",
+			args: []string{`-F`, `,`, `-b`, fmt.Sprintf(`Printf("%%q\n%%q\n%%q\n", ReadFields(%q, ""), ReadFields(%[1]q, " "), ReadFields(%[1]q, `+"`\\s*,\\s*`"+`))`, path)},
+			out: "[[\"1.2.3.4\" \"au\"] [\"5.6.7.8\" \"nz\"] [] [\"9.9.9.9 \" \" us\"]]\n" +
+				"[[\"1.2.3.4,au\"] [\"5.6.7.8,nz\"] [] [\"9.9.9.9\" \",\" \"us\"]]\n" +
+				"[[\"1.2.3.4\" \"au\"] [\"5.6.7.8\" \"nz\"] [] [\"9.9.9.9\" \"us\"]]\n",
+		},
+		{
+			name: "Getline()",
+			args: []string{fmt.Sprintf(`line, ok := Getline(%q); Println(S(1), line, ok)`, path), `-e`, fmt.Sprintf(`Close(%q); Println(Getline(%[1]q))`, path)},
+			in:   "a\nb\nc\nd\ne\nf\n",
+			out:  "a 1.2.3.4,au true\nb 5.6.7.8,nz true\nc  true\nd 9.9.9.9 , us true\ne  false\nf  false\n1.2.3.4,au true\n",
+		},
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests, test{
+			name: "Lines() error",
+			args: []string{`-b`, fmt.Sprintf(`Lines(%q)`, filepath.Join(dir, "nope"))},
+			err:  "error opening file: open " + filepath.Join(dir, "nope") + ": no such file or directory\n",
+		}, test{
+			name: "Command()",
+			args: []string{`-b`, `Println("start")`, `-b`, `lines := Command("echo one; echo two >&2; echo three; exit 1"); Printf("%q\n", lines)`},
+			out:  "start\ntwo\n[\"one\" \"three\"]\n",
+		})
+	}
+	runTests(t, tests)
+}
+
+func TestJoin(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"users.csv": "id,name,region\n1,alice,au\n2,\"bob, jr\",nz\n2,dup,xx\n",
+		"users.tsv": "alice\t1\tau\nbob jr\t2\tnz\n",
+		"users.txt": "au 1 alice\n\nnz 2 bob\n",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	csvPath := filepath.Join(dir, "users.csv")
+	input := "1 GET\n3 POST\n2 PUT\n"
+	tests := []test{
+		{
+			name: "inner",
+			args: []string{`-join`, csvPath, `-jheader`, `Println(S(0), JS(2), JoinS("region"))`},
+			in:   input,
+			out:  "1 GET alice au\n2 PUT bob, jr nz\njoin: 1 of 3 records unmatched\n",
+		},
+		{
+			name: "left",
+			args: []string{`-join`, csvPath, `-jheader`, `-jmode`, `left`, `Printf("%s %q\n", S(0), JoinS("name"))`},
+			in:   input,
+			out:  "1 GET \"alice\"\n3 POST \"\"\n2 PUT \"bob, jr\"\njoin: 1 of 3 records unmatched\n",
+		},
+		{
+			name: "anti",
+			args: []string{`-join`, csvPath, `-jmode`, `anti`, `Println(S(0), JS(1) == "")`},
+			in:   input,
+			out:  "3 POST true\n",
+		},
+		{
+			name: "all matched",
+			args: []string{`-join`, csvPath, `Println(JS(2))`},
+			in:   "1\n2\n",
+			out:  "alice\nbob, jr\n",
+		},
+		{
+			name: "TSV key column",
+			args: []string{`-join`, filepath.Join(dir, "users.tsv") + ":2", `-jkey`, `2`, `Println(S(1), JS(1), JS(3), JS(4) == "")`},
+			in:   "GET 2\nPUT 1\n",
+			out:  "GET bob jr nz true\nPUT alice au true\n",
+		},
+		{
+			name: "-F format",
+			args: []string{`-join`, filepath.Join(dir, "users.txt") + ":2", `Println(JS(3), JS(1))`},
+			in:   "2\n1\n",
+			out:  "bob nz\nalice au\n",
+		},
+		{
+			name: "JoinS() without header",
+			args: []string{`-join`, csvPath, `JoinS("name")`},
+			in:   "1\n",
+			err:  "JoinS requires -join file with -jheader\n",
+		},
+		{
+			name: "JoinS() unknown column",
+			args: []string{`-join`, csvPath, `-jheader`, `JoinS("age")`},
+			in:   "1\n",
+			err:  "JoinS: join file has no \"age\" column\n",
+		},
+		{
+			name: "invalid mode",
+			args: []string{`-join`, csvPath, `-jmode`, `outer`, `Println()`},
+			err:  "invalid join mode \"outer\" (must be inner, left, or anti)\n",
+		},
+		{
+			name: "invalid key column",
+			args: []string{`-join`, csvPath + ":0", `Println()`},
+			err:  "invalid join key column \"0\"\n",
+		},
+		{
+			name: "options without -join",
+			args: []string{`-jmode`, `left`, `Println()`},
+			err:  "-jkey, -jmode, and -jheader require -join\n",
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("command tests use Unix shell commands")
+	}
+	tests := []test{
+		{
+			name: "System()",
+			args: []string{`Println("before", NR()); Println(System("echo " + S(1) + "; exit " + S(2)))`},
+			in:   "a 0\nb 3\n",
+			out:  "before 1\na\n0\nbefore 2\nb\n3\n",
+		},
+		{
+			name: "System() stdin",
+			args: []string{`Println(System("cat"))`},
+			in:   "a\nb\n",
+			out:  "0\n0\n",
+		},
+		{
+			name: "Exec()",
+			args: []string{`out, status := Exec("sh", "-c", S(0)); Printf("%q %d\n", out, status)`},
+			in:   "echo x; exit 2\necho >&2 err\nkill -9 $$\n",
+			out:  "\"x\\n\" 2\nerr\n\"\" 0\n\"\" 137\n",
+		},
+		{
+			name: "Exec() without shell",
+			args: []string{`-b`, `Println(Exec("echo", "$HOME;", "a b"))`},
+			out:  "$HOME; a b\n 0\n",
+		},
+		{
+			name: "Exec() error",
+			args: []string{`-b`, `Exec("prig-no-such-program")`},
+			err:  "error running \"prig-no-such-program\": exec: \"prig-no-such-program\": executable file not found in $PATH\n",
+		},
+		{
+			name: "Start()",
+			args: []string{`-P`, `1`, `Start("sh", "-c", "echo " + S(1) + "; exit " + S(2))`, `-e`, `Println("failed", Wait()); Start("echo", "end")`},
+			in:   "a 0\nb 1\nc 0\nd 2\n",
+			out:  "a\nb\nc\nd\nfailed 2\nend\n",
+		},
+		{
+			name: "Start() concurrently",
+			// Each program waits (up to 5s) for the other to create its file.
+			args: []string{`-P`, `2`, `-b`, `dir := ` + strconv.Quote(t.TempDir()),
+				`Start("sh", "-c", "cd " + dir + "; touch " + S(1) + "; i=0; while [ ! -e " + S(2) + " ] && [ $i -lt 500 ]; do sleep 0.01; i=$((i+1)); done; [ -e " + S(2) + " ]")`,
+				`-e`, `Println(Wait())`},
+			in:  "a b\nb a\n",
+			out: "0\n",
+		},
+		{
+			name: "invalid -P",
+			args: []string{`-P`, `x`, `Println()`},
+			err:  "invalid number of commands \"x\"\n",
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestPromFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "prig.prom")
+	cmd := exec.Command("./prig", goExeArgs("-prom", path, `PromCounter("lines_total", "Lines read.").Inc()`)...)
+	cmd.Stdin = strings.NewReader("a\nb\n")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error running prig: %v\n%s", err, output)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# HELP lines_total Lines read.\n# TYPE lines_total counter\nlines_total 2\n"
+	if string(content) != want {
+		t.Fatalf("expected %q, got %q", want, content)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only metrics file in directory, got %d entries", len(entries))
+	}
+}